@@ -0,0 +1,304 @@
+package puredb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Aggregator computes a value over the records of a bucket, see Aggregate.
+type Aggregator struct {
+	op    string
+	field string
+}
+
+// Count counts the records.
+func Count() Aggregator {
+	return Aggregator{op: "count"}
+}
+
+// Sum sums the field over the records. The result is an int64 if all the
+// values are integers, a float64 otherwise.
+func Sum(field string) Aggregator {
+	return Aggregator{op: "sum", field: field}
+}
+
+// Min returns the smallest value of the field, compared like index values.
+func Min(field string) Aggregator {
+	return Aggregator{op: "min", field: field}
+}
+
+// Max returns the largest value of the field, compared like index values.
+func Max(field string) Aggregator {
+	return Aggregator{op: "max", field: field}
+}
+
+// Avg returns the average of the field as a float64.
+func Avg(field string) Aggregator {
+	return Aggregator{op: "avg", field: field}
+}
+
+func (agg Aggregator) String() string {
+	if agg.op == "count" {
+		return "count()"
+	}
+	return fmt.Sprintf("%s(%s)", agg.op, agg.field)
+}
+
+// Aggregation computes aggregators over the records of a bucket:
+//
+//	groups, err := bucket.Aggregate(Count(), Avg("Price"), Max("Year")).
+//		GroupBy("Author").
+//		Filter(available).
+//		Run()
+//
+// Fields are looked up like in queries. Nil fields are ignored by all the
+// aggregators but Count. Records are decoded and aggregated one at a time
+// in a single read-only transaction, so that memory only grows with the
+// number of groups.
+type Aggregation struct {
+	bucket      *Bucket
+	aggregators []Aggregator
+	groupBy     string
+	grouped     bool
+	from        interface{}
+	to          interface{}
+	filter      BucketPredicate
+	err         error
+}
+
+// AggregateGroup holds the results of an aggregation for a group of
+// records.
+type AggregateGroup struct {
+	// Key is the value of the GroupBy field of the records in the group,
+	// nil when not grouping.
+	Key interface{}
+	// Values are the results of the aggregators, in the order they were
+	// given. Min, Max and Avg are nil when no record has the field.
+	Values []interface{}
+}
+
+// Aggregate returns a new aggregation computing aggregators over the
+// records of the bucket.
+func (bucket *Bucket) Aggregate(aggregators ...Aggregator) *Aggregation {
+	a := &Aggregation{bucket: bucket, aggregators: aggregators}
+	if len(aggregators) == 0 {
+		a.err = fmt.Errorf("puredb: no aggregators")
+	}
+	return a
+}
+
+// GroupBy computes the aggregators separately for each distinct value of
+// field.
+func (a *Aggregation) GroupBy(field string) *Aggregation {
+	a.groupBy, a.grouped = field, true
+	return a
+}
+
+// Range restricts the aggregation to the records with keys in [from, to).
+// Either can be nil, for no bound.
+func (a *Aggregation) Range(from interface{}, to interface{}) *Aggregation {
+	a.from, a.to = from, to
+	return a
+}
+
+// Filter restricts the aggregation to the records for which fn returns
+// true.
+func (a *Aggregation) Filter(fn BucketPredicate) *Aggregation {
+	a.filter = fn
+	return a
+}
+
+// aggregateState accumulates an aggregator over a group.
+type aggregateState struct {
+	count   int64
+	isum    int64
+	fsum    float64
+	floats  bool
+	best    interface{}
+	bestEnc []byte
+}
+
+type aggregateGroupState struct {
+	key    interface{}
+	enc    []byte
+	states []aggregateState
+}
+
+// Run computes the aggregation, returning a group per distinct value of
+// the GroupBy field, in the order of the values, or a single group.
+func (a *Aggregation) Run() ([]AggregateGroup, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	bucket := a.bucket
+	db := bucket.DB
+	start := time.Now()
+
+	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+	first := prefix
+	var end []byte
+	if a.from != nil {
+		k_b, err := bucket.MarshalKey(a.from)
+		if err != nil {
+			return nil, err
+		}
+		first = bucket.recordKey(k_b)
+	}
+	if a.to != nil {
+		k_b, err := bucket.MarshalKey(a.to)
+		if err != nil {
+			return nil, err
+		}
+		end = bucket.recordKey(k_b)
+	}
+
+	groups := make(map[string]*aggregateGroupState)
+	if !a.grouped {
+		groups[""] = &aggregateGroupState{states: make([]aggregateState, len(a.aggregators))}
+	}
+	records := 0
+
+	err := db.view(func(txn StorageTxn) error {
+		it := txn.NewIterator(defaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(first); it.ValidForPrefix(prefix); it.Next() {
+			k_prefixed := it.Key()
+			if end != nil && bytes.Compare(k_prefixed, end) >= 0 {
+				break
+			}
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			k_b := k_prefixed[len(prefix):]
+
+			var k interface{}
+			var v interface{}
+			if err := bucket.UnmarshalKey(k_b, &k); err != nil {
+				return err
+			}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return err
+			}
+			if a.filter != nil {
+				ok, err := a.filter(bucket, k, v)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+			}
+			records++
+
+			group := groups[""]
+			if a.grouped {
+				gv, err := fieldValue(v, a.groupBy)
+				if err != nil {
+					return err
+				}
+				enc, err := encodeIndexValue(gv)
+				if err != nil {
+					return err
+				}
+				group = groups[string(enc)]
+				if group == nil {
+					group = &aggregateGroupState{key: gv, enc: enc, states: make([]aggregateState, len(a.aggregators))}
+					groups[string(enc)] = group
+				}
+			}
+
+			for i, agg := range a.aggregators {
+				if err := group.states[i].add(agg, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	db.logger.Debug("puredb: aggregate", "bucket", bucket.Name, "records", records, "groups", len(groups), "duration", time.Since(start), "err", err)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*aggregateGroupState, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].enc, sorted[j].enc) < 0
+	})
+
+	results := make([]AggregateGroup, len(sorted))
+	for i, group := range sorted {
+		results[i].Key = group.key
+		for j, agg := range a.aggregators {
+			results[i].Values = append(results[i].Values, group.states[j].result(agg))
+		}
+	}
+	return results, nil
+}
+
+func (s *aggregateState) add(agg Aggregator, v interface{}) error {
+	if agg.op == "count" {
+		s.count++
+		return nil
+	}
+
+	fv, err := fieldValue(v, agg.field)
+	if err != nil || fv == nil {
+		return err
+	}
+	s.count++
+
+	switch agg.op {
+	case "min", "max":
+		enc, err := encodeIndexValue(fv)
+		if err != nil {
+			return err
+		}
+		cmp := bytes.Compare(enc, s.bestEnc)
+		if s.bestEnc == nil || agg.op == "min" && cmp < 0 || agg.op == "max" && cmp > 0 {
+			s.best, s.bestEnc = fv, enc
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(fv)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.isum += rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		s.isum += int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		s.fsum += rv.Float()
+		s.floats = true
+	default:
+		return fmt.Errorf("puredb: can't compute %v of %T values", agg, fv)
+	}
+	return nil
+}
+
+func (s *aggregateState) result(agg Aggregator) interface{} {
+	switch agg.op {
+	case "count":
+		return s.count
+	case "sum":
+		if s.floats {
+			return s.fsum + float64(s.isum)
+		}
+		return s.isum
+	case "avg":
+		if s.count == 0 {
+			return nil
+		}
+		return (s.fsum + float64(s.isum)) / float64(s.count)
+	}
+	return s.best
+}
@@ -0,0 +1,56 @@
+package puredb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	forEachBackend(t, testAggregate)
+}
+
+func testAggregate(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	bucket := addQueryBooks(t, db)
+
+	groups, err := bucket.Aggregate(Count(), Sum("Year"), Min("Price"), Max("Title"), Avg("Year")).Run()
+	if err != nil {
+		t.Fatalf("can't aggregate - err:%v", err)
+	}
+	if len(groups) != 1 || fmt.Sprint(groups[0].Values) != "[100 159950 0 title 99 1599.5]" {
+		t.Fatalf("aggregate returned %+v", groups)
+	}
+
+	available := func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+		return v.(Book).Available, nil
+	}
+	groups, err = bucket.Aggregate(Count(), Sum("Price"), Max("Year")).GroupBy("Author").Range(int64(10), int64(40)).Filter(available).Run()
+	if err != nil {
+		t.Fatalf("can't aggregate - err:%v", err)
+	}
+	// even ids in [10, 40), grouped by id % 7
+	if len(groups) != 7 || groups[0].Key != "author 0" || fmt.Sprint(groups[0].Values) != "[2 54 1578]" {
+		t.Fatalf("grouped aggregate returned %+v", groups)
+	}
+	total := int64(0)
+	for _, group := range groups {
+		total += group.Values[0].(int64)
+	}
+	if total != 15 {
+		t.Fatalf("groups count %d records, expected 15", total)
+	}
+
+	if _, err := bucket.Aggregate(Sum("Title")).Run(); err == nil {
+		t.Fatal("expected an error summing strings")
+	}
+	if _, err := bucket.Aggregate().Run(); err == nil {
+		t.Fatal("expected an error without aggregators")
+	}
+
+	groups, _ = bucket.Aggregate(Count(), Avg("Year")).Range(int64(200), nil).Run()
+	if fmt.Sprint(groups[0].Values) != "[0 <nil>]" {
+		t.Fatalf("aggregate of an empty range returned %+v", groups)
+	}
+}
@@ -0,0 +1,384 @@
+package puredb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// btree is a persistent B-tree mapping byte-string keys to values, ordered
+// by bytes.Compare.
+//
+// Nodes reachable from a btree are never modified: set and delete copy the
+// nodes on the path they change and return a new tree sharing the rest.
+// This makes a *btree a free, immutable snapshot, which is what the memory
+// storage uses for its transactions and iterators.
+//
+// The structure and the rebalancing strategy follow github.com/google/btree.
+type btree struct {
+	root   *btreeNode
+	length int
+}
+
+const (
+	btreeDegree   = 16
+	btreeMaxItems = btreeDegree*2 - 1
+	btreeMinItems = btreeDegree - 1
+)
+
+type btreeItem struct {
+	key   []byte
+	value []byte
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+}
+
+const (
+	btreeRemoveKey = iota
+	btreeRemoveMax
+)
+
+func (t *btree) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.length
+}
+
+// get returns the value stored at key.
+func (t *btree) get(key []byte) ([]byte, bool) {
+	if t == nil {
+		return nil, false
+	}
+	for n := t.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return nil, false
+}
+
+// set returns a copy of the tree where key maps to value.
+func (t *btree) set(key, value []byte) *btree {
+	item := btreeItem{key: key, value: value}
+	if t == nil || t.root == nil {
+		return &btree{root: &btreeNode{items: []btreeItem{item}}, length: 1}
+	}
+
+	root := t.root.clone()
+	if len(root.items) >= btreeMaxItems {
+		mid, second := root.split(btreeMaxItems / 2)
+		root = &btreeNode{
+			items:    []btreeItem{mid},
+			children: []*btreeNode{root, second},
+		}
+	}
+
+	length := t.length
+	if !root.insert(item) {
+		length++
+	}
+	return &btree{root: root, length: length}
+}
+
+// delete returns a copy of the tree without key.
+func (t *btree) delete(key []byte) *btree {
+	if t == nil || t.root == nil {
+		return t
+	}
+
+	root := t.root.clone()
+	if _, removed := root.remove(key, btreeRemoveKey); !removed {
+		return t
+	}
+
+	if len(root.items) == 0 {
+		if len(root.children) > 0 {
+			root = root.children[0]
+		} else {
+			root = nil
+		}
+	}
+	return &btree{root: root, length: t.length - 1}
+}
+
+// min returns the item with the smallest key, or nil if the tree is empty.
+func (t *btree) min() *btreeItem {
+	if t == nil || t.root == nil {
+		return nil
+	}
+	n := t.root
+	for len(n.children) > 0 {
+		n = n.children[0]
+	}
+	return &n.items[0]
+}
+
+// max returns the item with the largest key, or nil if the tree is empty.
+func (t *btree) max() *btreeItem {
+	if t == nil || t.root == nil {
+		return nil
+	}
+	n := t.root
+	for len(n.children) > 0 {
+		n = n.children[len(n.children)-1]
+	}
+	return &n.items[len(n.items)-1]
+}
+
+// seekGE returns the item with the smallest key >= key.
+func (t *btree) seekGE(key []byte) *btreeItem {
+	return t.seekUp(key, 0)
+}
+
+// seekGT returns the item with the smallest key > key.
+func (t *btree) seekGT(key []byte) *btreeItem {
+	return t.seekUp(key, 1)
+}
+
+// seekLE returns the item with the largest key <= key.
+func (t *btree) seekLE(key []byte) *btreeItem {
+	return t.seekDown(key, 1)
+}
+
+// seekLT returns the item with the largest key < key.
+func (t *btree) seekLT(key []byte) *btreeItem {
+	return t.seekDown(key, 0)
+}
+
+// seekUp returns the smallest item whose key compares to key with a result
+// >= cmp.
+func (t *btree) seekUp(key []byte, cmp int) *btreeItem {
+	if t == nil {
+		return nil
+	}
+	var best *btreeItem
+	for n := t.root; n != nil; {
+		i := sort.Search(len(n.items), func(j int) bool {
+			return bytes.Compare(n.items[j].key, key) >= cmp
+		})
+		if i < len(n.items) {
+			best = &n.items[i]
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return best
+}
+
+// seekDown returns the largest item whose key compares to key with a
+// result < cmp.
+func (t *btree) seekDown(key []byte, cmp int) *btreeItem {
+	if t == nil {
+		return nil
+	}
+	var best *btreeItem
+	for n := t.root; n != nil; {
+		i := sort.Search(len(n.items), func(j int) bool {
+			return bytes.Compare(n.items[j].key, key) >= cmp
+		})
+		if i > 0 {
+			best = &n.items[i-1]
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return best
+}
+
+// find returns the index where key is, or where it should be inserted.
+func (n *btreeNode) find(key []byte) (int, bool) {
+	i := sort.Search(len(n.items), func(j int) bool {
+		return bytes.Compare(key, n.items[j].key) < 0
+	})
+	if i > 0 && bytes.Equal(n.items[i-1].key, key) {
+		return i - 1, true
+	}
+	return i, false
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	c := &btreeNode{
+		items: make([]btreeItem, len(n.items), btreeMaxItems+1),
+	}
+	copy(c.items, n.items)
+	if len(n.children) > 0 {
+		c.children = make([]*btreeNode, len(n.children), btreeMaxItems+2)
+		copy(c.children, n.children)
+	}
+	return c
+}
+
+// split splits the (owned) node at index i, returning the item at i and a
+// new node with everything after it.
+func (n *btreeNode) split(i int) (btreeItem, *btreeNode) {
+	item := n.items[i]
+	next := &btreeNode{}
+	next.items = make([]btreeItem, len(n.items)-i-1, btreeMaxItems+1)
+	copy(next.items, n.items[i+1:])
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = make([]*btreeNode, len(n.children)-i-1, btreeMaxItems+2)
+		copy(next.children, n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+// insert adds item to the subtree rooted at the (owned, non-full) node n,
+// copying the nodes it descends into. It reports whether an existing item
+// was replaced.
+func (n *btreeNode) insert(item btreeItem) bool {
+	i, found := n.find(item.key)
+	if found {
+		n.items[i] = item
+		return true
+	}
+	if len(n.children) == 0 {
+		n.items = insertItemAt(n.items, i, item)
+		return false
+	}
+
+	child := n.children[i].clone()
+	n.children[i] = child
+	if len(child.items) >= btreeMaxItems {
+		mid, second := child.split(btreeMaxItems / 2)
+		n.items = insertItemAt(n.items, i, mid)
+		n.children = insertChildAt(n.children, i+1, second)
+		switch c := bytes.Compare(item.key, mid.key); {
+		case c == 0:
+			n.items[i] = item
+			return true
+		case c > 0:
+			child = second
+		}
+	}
+	return child.insert(item)
+}
+
+// remove removes an item from the subtree rooted at the (owned) node n,
+// copying the nodes it changes.
+func (n *btreeNode) remove(key []byte, typ int) (btreeItem, bool) {
+	var i int
+	var found bool
+	switch typ {
+	case btreeRemoveMax:
+		if len(n.children) == 0 {
+			item := n.items[len(n.items)-1]
+			n.items = n.items[:len(n.items)-1]
+			return item, true
+		}
+		i = len(n.items)
+	case btreeRemoveKey:
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if !found {
+				return btreeItem{}, false
+			}
+			item := n.items[i]
+			n.items = removeItemAt(n.items, i)
+			return item, true
+		}
+	}
+
+	if len(n.children[i].items) <= btreeMinItems {
+		return n.growChildAndRemove(i, key, typ)
+	}
+
+	child := n.children[i].clone()
+	n.children[i] = child
+	if found {
+		// replace the item with its predecessor
+		out := n.items[i]
+		n.items[i], _ = child.remove(nil, btreeRemoveMax)
+		return out, true
+	}
+	return child.remove(key, typ)
+}
+
+// growChildAndRemove makes sure child i has more than btreeMinItems items,
+// stealing from a sibling or merging with it, then retries the removal.
+func (n *btreeNode) growChildAndRemove(i int, key []byte, typ int) (btreeItem, bool) {
+	if i > 0 && len(n.children[i-1].items) > btreeMinItems {
+		child := n.children[i].clone()
+		left := n.children[i-1].clone()
+		n.children[i] = child
+		n.children[i-1] = left
+
+		stolen := left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		child.items = insertItemAt(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		if len(left.children) > 0 {
+			c := left.children[len(left.children)-1]
+			left.children = left.children[:len(left.children)-1]
+			child.children = insertChildAt(child.children, 0, c)
+		}
+	} else if i < len(n.items) && len(n.children[i+1].items) > btreeMinItems {
+		child := n.children[i].clone()
+		right := n.children[i+1].clone()
+		n.children[i] = child
+		n.children[i+1] = right
+
+		stolen := right.items[0]
+		right.items = removeItemAt(right.items, 0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(right.children) > 0 {
+			c := right.children[0]
+			right.children = removeChildAt(right.children, 0)
+			child.children = append(child.children, c)
+		}
+	} else {
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.children[i].clone()
+		mergeItem := n.items[i]
+		mergeChild := n.children[i+1]
+		n.items = removeItemAt(n.items, i)
+		n.children = removeChildAt(n.children, i+1)
+		child.items = append(child.items, mergeItem)
+		child.items = append(child.items, mergeChild.items...)
+		child.children = append(child.children, mergeChild.children...)
+		n.children[i] = child
+	}
+	return n.remove(key, typ)
+}
+
+func insertItemAt(items []btreeItem, i int, item btreeItem) []btreeItem {
+	items = append(items, btreeItem{})
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+func removeItemAt(items []btreeItem, i int) []btreeItem {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = btreeItem{}
+	return items[:len(items)-1]
+}
+
+func insertChildAt(children []*btreeNode, i int, child *btreeNode) []*btreeNode {
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = child
+	return children
+}
+
+func removeChildAt(children []*btreeNode, i int) []*btreeNode {
+	copy(children[i:], children[i+1:])
+	children[len(children)-1] = nil
+	return children[:len(children)-1]
+}
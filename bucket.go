@@ -1,11 +1,11 @@
 package puredb
 
 import (
-	"github.com/dgraph-io/badger"
+	"bytes"
 	"fmt"
 	"encoding/binary"
+	"sync"
 	"time"
-	"log"
 )
 
 
@@ -14,6 +14,9 @@ type UnmarshalFn func(data []byte, v *interface{}) error
 
 type BucketCallback func(bucket *Bucket, k interface{}, v interface{}) error
 
+// BucketKeyCallback is called with the keys of the records by IterateKeys.
+type BucketKeyCallback func(bucket *Bucket, k interface{}) error
+
 type BucketPredicate func(bucket *Bucket, k interface{}, v interface{}) (bool, error)
 
 type BucketOpts struct {
@@ -22,6 +25,67 @@ type BucketOpts struct {
 	MarshalValueFn   MarshalFn
 	UnmarshalValueFn UnmarshalFn
 	PreAddFn         BucketCallback
+
+	// Compression compresses values after MarshalValueFn. Values are
+	// stored with a header byte recording how they were compressed, so
+	// changing it only affects the values written afterwards. The values
+	// of buckets set up before there were headers are stored uncompressed
+	// until Migrate adds them.
+	Compression Compression
+	// Encryption, if set, encrypts values with AES-GCM after compressing
+	// them, using the keys it provides.
+	// DatabaseKey uses the key set with WithEncryptionKey.
+	Encryption KeyProvider
+
+	// SchemaVersion, if not zero, is the version of the values produced by
+	// MarshalValueFn. It's stored with each value, and values stored with
+	// an older version are upgraded through Upgrades before being passed
+	// to UnmarshalValueFn, or in place by Migrate. Values stored before the
+	// bucket had a SchemaVersion are version 1.
+	SchemaVersion uint32
+	// Upgrades maps each schema version before SchemaVersion to the
+	// function converting values from it to the next one.
+	Upgrades map[uint32]UpgradeFn
+
+	// IDGenerator assigns the keys of the records added with Add and
+	// Insert, and is passed to PreAddFn. Without one, keys are int64 from
+	// a SequenceGenerator, stored as big-endian unsigned integers.
+	IDGenerator IDGenerator
+	// MergeFn combines the values of the records with the operands
+	// passed to Merge. Buckets with a MergeFn can't have Indexes.
+	//
+	// Only Get, Counter and Incr apply the operands not compacted yet:
+	// Iterate, Search, Query and the other scans see the records as of
+	// the last compaction, so they can disagree with Get until the
+	// operands are compacted, see CompactMerges.
+	MergeFn MergeFn
+	// MergeCompactInterval, if more than zero, is how often merge
+	// operands are compacted into the records in the background. Without
+	// it, operands are only compacted by CompactMerges.
+	MergeCompactInterval time.Duration
+
+	// CounterShards, if more than 1, spreads the increments of Incr over
+	// that many sub-keys of each counter, summed with the record by Get
+	// and Counter. Iterate and the other scans only see the records, and
+	// the value returned by Incr is only approximate.
+	CounterShards int
+
+	// IdempotencyTTL is how long AddIdempotent remembers idempotency
+	// keys, 24 hours if zero.
+	IdempotencyTTL time.Duration
+
+	// MaxEntries and MaxBytes, if not zero, cap the number of records of
+	// the bucket and their total size, keys included. Add and Insert evict
+	// the first records, as Pop(false) would, in the same transaction, to
+	// stay within them. The writes to a capped bucket all update its
+	// record count, so concurrent ones conflict.
+	MaxEntries int
+	MaxBytes   int64
+
+	// Indexes are the secondary indexes of the bucket, kept up to date by
+	// Add, Set, Delete and Pop and queried with Lookup. Indexes added to a
+	// bucket holding records are built by Setup.
+	Indexes []IndexOpts
 }
 
 //type BucketInterface interface {
@@ -61,42 +125,95 @@ type BucketOpts struct {
 
 type Bucket struct {
 	DB *PureDB
-	badgerDB *badger.DB
 
 	Name string
 	Opts BucketOpts
-	Seq  *badger.Sequence
+	Seq  StorageSequence
 
 	MarshalKeyFn MarshalFn
 	UnmarshalKeyFn UnmarshalFn
 	MarshalValueFn MarshalFn
 	UnmarshalValueFn UnmarshalFn
-}
 
-func (bucket *Bucket) Badger() *badger.DB {
-	return bucket.badgerDB
+	statsMu sync.Mutex
+	stats   *plannerStats
+
+	// framedAll is set when all the values of the bucket are stored in
+	// envelopes, see framed.
+	framedAll bool
+
+	mergeState
 }
 
 func (bucket *Bucket) Setup(db *PureDB, name string, opts BucketOpts) error {
 	bucket.DB = db
-	bucket.badgerDB = db.DB
 	bucket.Name = name
 	bucket.Opts = opts
 
-	seq, err := bucket.badgerDB.GetSequence([]byte(bucket.Name), 100)
-	bucket.Seq = seq
-
 	bucket.MarshalKeyFn = bucket.Opts.MarshalKeyFn
 	bucket.UnmarshalKeyFn = bucket.Opts.UnmarshalKeyFn
 	bucket.MarshalValueFn = bucket.Opts.MarshalValueFn
 	bucket.UnmarshalValueFn = bucket.Opts.UnmarshalValueFn
 
-	return err
+	if bucket.Opts.Compression != CompressionNone {
+		if _, err := bucket.Opts.Compression.codec(); err != nil {
+			return err
+		}
+	}
+
+	if bucket.Opts.Encryption == DatabaseKey {
+		if db.encryption == nil {
+			return fmt.Errorf("puredb: bucket %q uses the database key, but the database has none, see WithEncryptionKey", name)
+		}
+		bucket.Opts.Encryption = db.encryption
+	}
+	if bucket.Opts.Encryption != nil {
+		id, key, err := bucket.Opts.Encryption.CurrentKey()
+		if err != nil {
+			return err
+		}
+		if err := checkEncryptionKey(id, key); err != nil {
+			return err
+		}
+	}
+
+	if err := bucket.checkUpgrades(); err != nil {
+		return err
+	}
+	if err := bucket.checkIndexes(); err != nil {
+		return err
+	}
+	if err := bucket.setupFormat(); err != nil {
+		return err
+	}
+	if err := bucket.setupIndexes(); err != nil {
+		return err
+	}
+	if err := bucket.setupStats(); err != nil {
+		return err
+	}
+	if err := bucket.setupCapacity(); err != nil {
+		return err
+	}
+
+	if !db.readOnly {
+		// leasing a sequence writes to the database
+		seq, err := db.storage.GetSequence([]byte(bucket.Name), db.seqBandwidth)
+		if err != nil {
+			return err
+		}
+		bucket.Seq = seq
+	}
+
+	return bucket.setupMerges()
 }
 
 func (bucket *Bucket) Cleanup() {
-	bucket.Seq.Release()
-	bucket.Seq = nil
+	bucket.cleanupMerges()
+	if bucket.Seq != nil {
+		bucket.Seq.Release()
+		bucket.Seq = nil
+	}
 }
 
 func (bucket *Bucket) GetName() string {
@@ -123,62 +240,57 @@ func (bucket *Bucket) UnmarshalValue(data []byte, v *interface{}) error {
 	return bucket.UnmarshalValueFn(data, v)
 }
 
+// Add adds v to the bucket with a key assigned by its IDGenerator, which
+// must generate integers, and returns the key. See Insert for the others.
 func (bucket *Bucket) Add(v interface{}) (int64, error) {
-	db := bucket.badgerDB
+	var id int64
+	_, err := bucket.insert("add", v, "", func(k interface{}) error {
+		var err error
+		id, err = intID(k)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
 
-	var id uint64
+func (bucket *Bucket) Set(k interface{}, v interface{}) error {
+	db := bucket.DB
+	start := time.Now()
+	keySize := 0
 
-	err := db.Update(func(txn *badger.Txn) error {
+	err := db.update(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
-
-		num, err := bucket.Seq.Next()
+		k_b, err := bucket.MarshalKey(k)
 		if err != nil {
 			return err
 		}
-		k_b := u64tob(num)
-
-		id = num
-
-		if bucket.Opts.PreAddFn != nil {
-			err := bucket.Opts.PreAddFn(bucket, int64(num), v)
-			if err != nil {
-				return err
-			}
+		keySize = len(k_b)
+		if err := bucket.reindex(txn, k_b, v, false); err != nil {
+			return err
 		}
-
-		v_b, err := bucket.MarshalValue(v)
-		if err != nil {
+		if err := bucket.dropPending(txn, k_b); err != nil {
 			return err
 		}
-		k_prefixed := append(prefix, k_b...)
-		return txn.Set(k_prefixed, v_b)
-	})
-
-	return int64(id), err
-}
-
-func (bucket *Bucket) Set(k interface{}, v interface{}) error {
-	db := bucket.badgerDB
-
-	err := db.Update(func(txn *badger.Txn) error {
-		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
-		k_b, err := bucket.MarshalKey(k)
+		v_b, err := bucket.encodeValue(txn, k_b, v)
 		if err != nil {
 			return err
 		}
-		v_b, err := bucket.MarshalValue(v)
-		if err != nil {
+		if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
 			return err
 		}
 		k_prefixed := append(prefix, k_b...)
 		return txn.Set(k_prefixed, v_b)
 	})
 
+	bucket.logOp("set", start, keySize, err)
 	return err
 }
 
 func (bucket *Bucket) Get(k interface{}) (interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
+	start := time.Now()
 
 	k_b, err := bucket.MarshalKey(k)
 	if err != nil {
@@ -186,100 +298,137 @@ func (bucket *Bucket) Get(k interface{}) (interface{}, error) {
 	}
 	var v interface{}
 
-	err = db.View(func(txn *badger.Txn) error {
+	err = db.view(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 		k_prefixed := append(prefix, k_b...)
-		item, err := txn.Get(k_prefixed)
-		if err != nil {
-			return err
+		v_b, err := txn.Get(k_prefixed)
+		if bucket.Opts.CounterShards > 1 && (err == nil || err == ErrKeyNotFound) {
+			return bucket.getCounter(txn, k_b, err == nil, &v)
+		}
+		if bucket.Opts.MergeFn != nil && (err == nil || err == ErrKeyNotFound) {
+			return bucket.getMerged(txn, k_b, v_b, err == nil, &v)
 		}
-		v_b, err := item.Value()
 		if err != nil {
 			return err
 		}
 
-		err = bucket.UnmarshalValue(v_b, &v)
+		err = bucket.decodeValue(txn, k_b, v_b, &v)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
 
+	bucket.logOp("get", start, len(k_b), err)
 	return v, err
 }
 
 func (bucket *Bucket) Delete(k interface{}) error {
-	db := bucket.badgerDB
+	db := bucket.DB
+	start := time.Now()
 
 	k_b, err := bucket.MarshalKey(k)
 	if err != nil {
 		return err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
+	err = db.update(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		if err := bucket.reindex(txn, k_b, nil, true); err != nil {
+			return err
+		}
+		if err := bucket.dropPending(txn, k_b); err != nil {
+			return err
+		}
+		if err := bucket.trackCapacity(txn, k_b, nil); err != nil {
+			return err
+		}
 		k_prefixed := append(prefix, k_b...)
 		return txn.Delete(k_prefixed)
 	})
 
+	bucket.logOp("delete", start, len(k_b), err)
 	return err
 }
 
 func (bucket *Bucket) Pop(last bool) (interface{}, interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
+	start := time.Now()
+	keySize := 0
 
 	var k interface{}
 	var v interface{}
 
-	err := db.Update(func(txn *badger.Txn) error {
+	err := db.update(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 1
-		opts.Reverse = last
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		if last {
-			prefix = prefixBeyondEnd(prefix)
-		}
-
-		it.Seek(prefix)
+		// copy the record out, and close the iterator before deleting it:
+		// dropping its merge operands and counter shards needs another one
+		var k_b, v_b []byte
+		err := func() error {
+			opts := defaultIteratorOptions
+			opts.PrefetchSize = 1
+			opts.Reverse = last
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			if last {
+				seekBefore(it, prefixEnd(prefix))
+			} else {
+				it.Seek(prefix)
+			}
 
-		if (! it.ValidForPrefix(prefix)) {
-			// empty set
-			return fmt.Errorf("empty bucket")
-		}
+			if (! it.ValidForPrefix(prefix)) {
+				// empty set
+				return fmt.Errorf("empty bucket")
+			}
 
-		item := it.Item()
-		k_prefixed := item.Key()
-		v_b, err := item.Value()
+			value, err := it.Value()
+			if err != nil {
+				return err
+			}
+			k_b = append([]byte(nil), it.Key()[len(prefix):]...)
+			v_b = append([]byte(nil), value...)
+			return nil
+		}()
 		if err != nil {
 			return err
 		}
-
-		k_b := k_prefixed[len(prefix):]
+		keySize = len(k_b)
 
 		err = bucket.UnmarshalKey(k_b, &k)
 		if err != nil {
 			return err
 		}
-		err = bucket.UnmarshalValue(v_b, &v)
+		err = bucket.decodeValue(txn, k_b, v_b, &v)
 		if err != nil {
 			return err
 		}
 
+		if err := bucket.reindex(txn, k_b, nil, true); err != nil {
+			return err
+		}
+		if err := bucket.dropPending(txn, k_b); err != nil {
+			return err
+		}
+		if err := bucket.trackCapacity(txn, k_b, nil); err != nil {
+			return err
+		}
+		k_prefixed := bucket.recordKey(k_b)
 		return txn.Delete(k_prefixed)
 	})
 
+	bucket.logOp("pop", start, keySize, err)
 	return k, v, err
 }
 
+// Iterate calls fn with every record of the bucket, in key order. It stops
+// at the first error returned by fn, and returns it unless it's Stop.
 func (bucket *Bucket) Iterate(fn BucketCallback) error {
-	db := bucket.badgerDB
+	db := bucket.DB
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -287,9 +436,8 @@ func (bucket *Bucket) Iterate(fn BucketCallback) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			k_prefixed := item.Key()
-			v_b, err := item.Value()
+			k_prefixed := it.Key()
+			v_b, err := it.Value()
 			if err != nil {
 				return err
 			}
@@ -302,7 +450,7 @@ func (bucket *Bucket) Iterate(fn BucketCallback) error {
 			if err != nil {
 				return err
 			}
-			err = bucket.UnmarshalValue(v_b, &v_i)
+			err = bucket.decodeValue(txn, k_b, v_b, &v_i)
 			if err != nil {
 				return err
 			}
@@ -314,19 +462,57 @@ func (bucket *Bucket) Iterate(fn BucketCallback) error {
 		return nil
 	})
 
+	if err == Stop {
+		return nil
+	}
+	return err
+}
+
+// IterateKeys calls fn with the key of every record of the bucket, without
+// reading the values. fn can return Stop like in Iterate.
+func (bucket *Bucket) IterateKeys(fn BucketKeyCallback) error {
+	db := bucket.DB
+
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
+		opts.PrefetchValues = false				// key-only iteration
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k_b := it.Key()[len(prefix):]
+
+			var k_i interface{}
+			err := bucket.UnmarshalKey(k_b, &k_i)
+			if err != nil {
+				return err
+			}
+			err = fn(bucket, k_i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == Stop {
+		return nil
+	}
 	return err
 }
 
 func (bucket *Bucket) First() (interface{}, interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
 
 	var first_k interface{}
 	var first_v interface{}
 
-	err := db.View(func(txn *badger.Txn) error {
+	err := db.view(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
-		opts := badger.DefaultIteratorOptions
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 1
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -338,9 +524,8 @@ func (bucket *Bucket) First() (interface{}, interface{}, error) {
 			return fmt.Errorf("empty bucket")
 		}
 
-		item := it.Item()
-		k_prefixed := item.Key()
-		v_b, err := item.Value()
+		k_prefixed := it.Key()
+		v_b, err := it.Value()
 		if err != nil {
 			return err
 		}
@@ -351,7 +536,7 @@ func (bucket *Bucket) First() (interface{}, interface{}, error) {
 		if err != nil {
 			return err
 		}
-		err = bucket.UnmarshalValue(v_b, &first_v)
+		err = bucket.decodeValue(txn, k_b, v_b, &first_v)
 		if err != nil {
 			return err
 		}
@@ -363,30 +548,29 @@ func (bucket *Bucket) First() (interface{}, interface{}, error) {
 }
 
 func (bucket *Bucket) Last() (interface{}, interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
 
 	var last_k interface{}
 	var last_v interface{}
 
-	err := db.View(func(txn *badger.Txn) error {
+	err := db.view(func(txn StorageTxn) error {
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
-		opts := badger.DefaultIteratorOptions
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 1
 		opts.Reverse = true
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		it.Seek(prefixBeyondEnd(prefix))
+		seekBefore(it, prefixEnd(prefix))
 
 		if (! it.ValidForPrefix(prefix)) {
 			// empty set
 			return fmt.Errorf("empty bucket")
 		}
 
-		item := it.Item()
-		k_prefixed := item.Key()
-		v_b, err := item.Value()
+		k_prefixed := it.Key()
+		v_b, err := it.Value()
 		if err != nil {
 			return err
 		}
@@ -397,7 +581,7 @@ func (bucket *Bucket) Last() (interface{}, interface{}, error) {
 		if err != nil {
 			return err
 		}
-		err = bucket.UnmarshalValue(v_b, &last_v)
+		err = bucket.decodeValue(txn, k_b, v_b, &last_v)
 		if err != nil {
 			return err
 		}
@@ -408,13 +592,17 @@ func (bucket *Bucket) Last() (interface{}, interface{}, error) {
 	return last_k, last_v, err
 }
 
+// Search calls fn with every record whose value equals v, in key order,
+// and returns the key of the first one. It stops at the first error
+// returned by fn, and returns it unless it's Stop. With a nil fn, it stops
+// at the first match.
 func (bucket *Bucket) Search(v interface{}, fn BucketCallback) (interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
 
 	var found_at interface{}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -422,9 +610,8 @@ func (bucket *Bucket) Search(v interface{}, fn BucketCallback) (interface{}, err
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			k_prefixed := item.Key()
-			v_b, err := item.Value()
+			k_prefixed := it.Key()
+			v_b, err := it.Value()
 			if err != nil {
 				return err
 			}
@@ -437,21 +624,30 @@ func (bucket *Bucket) Search(v interface{}, fn BucketCallback) (interface{}, err
 			if err != nil {
 				return err
 			}
-			err = bucket.UnmarshalValue(v_b, &v_i)
+			err = bucket.decodeValue(txn, k_b, v_b, &v_i)
 			if err != nil {
 				return err
 			}
 
 			if v == v_i {
-				found_at = k_i
-				if fn != nil {
-					err = fn(bucket, k_i, v_i)
+				if found_at == nil {
+					found_at = k_i
+				}
+				if fn == nil {
+					return Stop
+				}
+				err = fn(bucket, k_i, v_i)
+				if err != nil {
+					return err
 				}
 			}
 		}
 		return nil
 	})
 
+	if err == Stop {
+		err = nil
+	}
 	return found_at, err
 }
 
@@ -459,13 +655,14 @@ func (bucket *Bucket) Search(v interface{}, fn BucketCallback) (interface{}, err
 //	SearchAll(cmpFn BucketPredicate, reverse bool) ([]interface{}, []interface{}, error)
 
 func (bucket *Bucket) SearchOne(v interface{}, cmpFn BucketPredicate, reverse bool) (interface{}, interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
+	start := time.Now()
 
 	var found_k interface{}
 	var found_v interface{}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 10
 		opts.Reverse = reverse
 		it := txn.NewIterator(opts)
@@ -474,13 +671,14 @@ func (bucket *Bucket) SearchOne(v interface{}, cmpFn BucketPredicate, reverse bo
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
 		if reverse {
-			prefix = prefixBeyondEnd(prefix)
+			seekBefore(it, prefixEnd(prefix))
+		} else {
+			it.Seek(prefix)
 		}
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			k_prefixed := item.Key()
-			v_b, err := item.Value()
+		for ; it.ValidForPrefix(prefix); it.Next() {
+			k_prefixed := it.Key()
+			v_b, err := it.Value()
 			if err != nil {
 				return err
 			}
@@ -493,15 +691,15 @@ func (bucket *Bucket) SearchOne(v interface{}, cmpFn BucketPredicate, reverse bo
 			if err != nil {
 				return err
 			}
-			err = bucket.UnmarshalValue(v_b, &v_i)
+			err = bucket.decodeValue(txn, k_b, v_b, &v_i)
 			if err != nil {
 				return err
 			}
 
 			if cmpFn != nil {
 				found, err := cmpFn(bucket, k_i, v_i)
-				if err != nil {
-					log.Printf("Bucket.SearchOne - error in cmpFn - k:%v v:%v err:%v", k_i, v_i, err)
+				if err != nil && err != Stop {
+					bucket.DB.logger.Debug("puredb: search one: error in cmpFn", "bucket", bucket.Name, "key", k_i, "err", err)
 					return err
 				}
 				if found {
@@ -509,6 +707,9 @@ func (bucket *Bucket) SearchOne(v interface{}, cmpFn BucketPredicate, reverse bo
 					found_v = v_i
 					break
 				}
+				if err == Stop {
+					break
+				}
 			} else {
 				if v == v_i {
 					found_k = k_i
@@ -520,17 +721,19 @@ func (bucket *Bucket) SearchOne(v interface{}, cmpFn BucketPredicate, reverse bo
 		return nil
 	})
 
+	bucket.DB.logger.Debug("puredb: search one", "bucket", bucket.Name, "found", found_k != nil, "duration", time.Since(start), "err", err)
 	return found_k, found_v, err
 }
 
 func (bucket *Bucket) SearchAll(v interface{}, cmpFn BucketPredicate, reverse bool) ([]interface{}, []interface{}, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
+	start := time.Now()
 
 	var found_k []interface{}
 	var found_v []interface{}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchSize = 10
 		opts.Reverse = reverse
 		it := txn.NewIterator(opts)
@@ -539,13 +742,14 @@ func (bucket *Bucket) SearchAll(v interface{}, cmpFn BucketPredicate, reverse bo
 		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
 
 		if reverse {
-			prefix = prefixBeyondEnd(prefix)
+			seekBefore(it, prefixEnd(prefix))
+		} else {
+			it.Seek(prefix)
 		}
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			k_prefixed := item.Key()
-			v_b, err := item.Value()
+		for ; it.ValidForPrefix(prefix); it.Next() {
+			k_prefixed := it.Key()
+			v_b, err := it.Value()
 			if err != nil {
 				return err
 			}
@@ -558,21 +762,24 @@ func (bucket *Bucket) SearchAll(v interface{}, cmpFn BucketPredicate, reverse bo
 			if err != nil {
 				return err
 			}
-			err = bucket.UnmarshalValue(v_b, &v_i)
+			err = bucket.decodeValue(txn, k_b, v_b, &v_i)
 			if err != nil {
 				return err
 			}
 
 			if cmpFn != nil {
 				found, err := cmpFn(bucket, k_i, v_i)
-				if err != nil {
-					log.Printf("Bucket.SearchAll - error in cmpFn k:%v v:%v err:%v", k_i, v_i, err)
+				if err != nil && err != Stop {
+					bucket.DB.logger.Debug("puredb: search all: error in cmpFn", "bucket", bucket.Name, "key", k_i, "err", err)
 					return err
 				}
 				if found {
 					found_k = append(found_k, k_i)
 					found_v = append(found_v, v_i)
 				}
+				if err == Stop {
+					break
+				}
 			} else {
 				if v == v_i {
 					found_k = append(found_k, k_i)
@@ -583,6 +790,7 @@ func (bucket *Bucket) SearchAll(v interface{}, cmpFn BucketPredicate, reverse bo
 		return nil
 	})
 
+	bucket.DB.logger.Debug("puredb: search all", "bucket", bucket.Name, "matches", len(found_k), "duration", time.Since(start), "err", err)
 	return found_k, found_v, err
 }
 
@@ -591,12 +799,12 @@ func (bucket *Bucket) SearchAll(v interface{}, cmpFn BucketPredicate, reverse bo
 //	// Empty
 
 func (bucket *Bucket) Count() (int, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
 
 	count := 0
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchValues = false				// key-only iteration
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -615,12 +823,12 @@ func (bucket *Bucket) Count() (int, error) {
 }
 
 func (bucket *Bucket) Empty() (bool, error) {
-	db := bucket.badgerDB
+	db := bucket.DB
 
 	empty := true
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
 		opts.PrefetchValues = false				// key-only iteration
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -635,6 +843,70 @@ func (bucket *Bucket) Empty() (bool, error) {
 	return empty, err
 }
 
+// logOp emits a debug record for a single-key bucket operation.
+func (bucket *Bucket) logOp(op string, start time.Time, keySize int, err error) {
+	bucket.DB.logger.Debug("puredb: "+op, "bucket", bucket.Name, "key_size", keySize, "duration", time.Since(start), "err", err)
+}
+
+// BucketStats describes the contents of a bucket.
+type BucketStats struct {
+	Count      int
+	KeyBytes   int64
+	// ValueBytes is the size of the values as stored, RawValueBytes their
+	// size as produced by MarshalValueFn.
+	ValueBytes    int64
+	RawValueBytes int64
+	// CompressedValues is the number of values stored compressed.
+	CompressedValues int
+	// CompressionRatio is RawValueBytes / ValueBytes (1 for an empty
+	// bucket).
+	CompressionRatio float64
+}
+
+// Stats scans the bucket and returns statistics about its contents.
+func (bucket *Bucket) Stats() (BucketStats, error) {
+	db := bucket.DB
+
+	stats := BucketStats{}
+
+	err := db.view(func(txn StorageTxn) error {
+		it := txn.NewIterator(defaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			k_b := it.Key()[len(prefix):]
+			framed, err := bucket.framed(txn, k_b)
+			if err != nil {
+				return err
+			}
+			data, _, err := bucket.openValue(txn, k_b, v_b)
+			if err != nil {
+				return err
+			}
+			stats.Count++
+			stats.KeyBytes += int64(len(k_b))
+			stats.ValueBytes += int64(len(v_b))
+			stats.RawValueBytes += int64(len(data))
+			if framed && compressionCodec(v_b[0]&envelopeCodecMask) != codecStored {
+				stats.CompressedValues++
+			}
+		}
+		return nil
+	})
+
+	stats.CompressionRatio = 1
+	if stats.ValueBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawValueBytes) / float64(stats.ValueBytes)
+	}
+	return stats, err
+}
+
 // itob returns an 8-byte big endian representation of v.
 func itob(v int) []byte {
 	b := make([]byte, 8)
@@ -649,6 +921,15 @@ func i64tob(v int64) []byte {
 	return b
 }
 
+// btoi64 returns the int64 of an 8-byte big endian representation, or an
+// error if data isn't 8 bytes long, as happens with corrupt values.
+func btoi64(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("puredb: invalid int64 length %d", len(data))
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
 // u64tob returns an 8-byte big endian representation of v.
 func u64tob(v uint64) []byte {
 	b := make([]byte, 8)
@@ -661,14 +942,22 @@ var BucketOptsIntInt = BucketOpts{
 		return i64tob(v.(int64)), nil
 	},
 	UnmarshalKeyFn: func (data []byte, v *interface{}) error {
-		*v = int64(binary.BigEndian.Uint64(data))
+		i, err := btoi64(data)
+		if err != nil {
+			return err
+		}
+		*v = i
 		return nil
 	},
 	MarshalValueFn: func (v interface{}) ([]byte, error) {
 		return i64tob(v.(int64)), nil
 	},
 	UnmarshalValueFn: func (data []byte, v *interface{}) error {
-		*v = int64(binary.BigEndian.Uint64(data))
+		i, err := btoi64(data)
+		if err != nil {
+			return err
+		}
+		*v = i
 		return nil
 	},
 }
@@ -709,11 +998,61 @@ var BucketOptsTimeInt = BucketOpts{
 		return i64tob(v.(int64)), nil
 	},
 	UnmarshalValueFn: func (data []byte, v *interface{}) error {
-		*v = int64(binary.BigEndian.Uint64(data))
+		i, err := btoi64(data)
+		if err != nil {
+			return err
+		}
+		*v = i
 		return nil
 	},
 }
 
-func prefixBeyondEnd(prefix []byte) []byte {
-	return append(prefix, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}...)		// trick, see https://github.com/dgraph-io/badger/issues/436#issuecomment-400095559
+// recordKey returns the key the record with key k_b is stored at.
+func (bucket *Bucket) recordKey(k_b []byte) []byte {
+	prefix := fmt.Sprintf("%s__", bucket.GetName())
+	k_prefixed := make([]byte, 0, len(prefix)+len(k_b))
+	k_prefixed = append(k_prefixed, prefix...)
+	return append(k_prefixed, k_b...)
+}
+
+// dropPending discards what's kept about the record with key k_b besides
+// its value: merge operands and counter shards.
+func (bucket *Bucket) dropPending(txn StorageTxn, k_b []byte) error {
+	if err := bucket.dropMerges(txn, k_b); err != nil {
+		return err
+	}
+	return bucket.dropShards(txn, k_b)
+}
+
+// prefixEnd returns the smallest key sorting after all the keys starting
+// with prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// seekBefore positions the reverse iterator it on the last key before
+// end, or on the last key if end is nil.
+func seekBefore(it StorageIterator, end []byte) {
+	if end == nil {
+		it.Rewind()
+		return
+	}
+	it.Seek(end)
+	if it.Valid() && bytes.Compare(it.Key(), end) >= 0 {
+		it.Next()
+	}
+}
+
+// keyAfter returns the smallest key sorting after k.
+func keyAfter(k []byte) []byte {
+	after := make([]byte, len(k)+1)
+	copy(after, k)
+	return after
 }
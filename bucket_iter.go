@@ -1,70 +1,176 @@
 package puredb
 
 import (
-	"github.com/dgraph-io/badger"
+	"bytes"
 	"fmt"
 )
 
 type BucketIterOpts struct {
 	Prefix		[]byte
 	Reverse		bool
+	// KeysOnly doesn't prefetch the values, which are only read by Value
+	// and Get, for iterations that mostly need the keys.
+	KeysOnly	bool
+	// Lower and Upper, if not nil, restrict the iteration to the keys
+	// from Lower included to Upper excluded.
+	Lower		interface{}
+	Upper		interface{}
+	// PrefetchSize is the number of values read ahead, 10 if zero.
+	PrefetchSize	int
 }
 type BucketIter struct {
 	bucket	*Bucket
 	prefix	[]byte
-	txn		*badger.Txn
-	it		*badger.Iterator
-	bOpts	*badger.IteratorOptions
+	bucketPrefix	[]byte		// stripped from the keys
+	lower	[]byte				// first key of the range
+	upper	[]byte				// key after the range, nil for no end
+	txn		StorageTxn
+	it		StorageIterator
+	bOpts	*StorageIteratorOptions
 	Opts	BucketIterOpts
 	Err		error
 }
 
 func NewBucketIter(bucket *Bucket, opts BucketIterOpts) *BucketIter {
-	bOpts := badger.DefaultIteratorOptions
+	it := BucketIter{
+		bucket: bucket,
+	}
+	it.Reset(opts)
+
+	return &it
+}
+
+// Reset restarts the iterator with new options, on a new read-only
+// transaction, so that it sees the writes committed since it was created.
+func (it *BucketIter) Reset(opts BucketIterOpts) {
+	bucket := it.bucket
+	it.Close()
+
+	bOpts := defaultIteratorOptions
 	bOpts.PrefetchSize = 10
+	if opts.PrefetchSize > 0 {
+		bOpts.PrefetchSize = opts.PrefetchSize
+	}
 	bOpts.Reverse = opts.Reverse
+	bOpts.PrefetchValues = !opts.KeysOnly
 
-	db := bucket.badgerDB
+	db := bucket.DB
 
-	txn := db.NewTransaction(false)		// read-only transaction (update set to false)
+	txn := db.storage.NewTransaction(false)		// read-only transaction (update set to false)
 
-	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+	bucketPrefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+	prefix := append([]byte(nil), bucketPrefix...)
 	if len(opts.Prefix) > 0 {
 		prefix = append(prefix, opts.Prefix...)
 	}
-	if opts.Reverse {
-		prefix = append(prefix, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}...)		// trick, see https://github.com/dgraph-io/badger/issues/436#issuecomment-400095559
-	}
 
-	it := BucketIter{
+	*it = BucketIter{
 		bucket: bucket,
 		prefix: prefix,
+		bucketPrefix: bucketPrefix,
+		lower: prefix,
+		upper: prefixEnd(prefix),
 		txn: txn,
 		it: txn.NewIterator(bOpts),
 		bOpts: &bOpts,
 		Opts: opts,
 	}
 
-	it.it.Seek(it.prefix)
+	if opts.Lower != nil {
+		k_b, err := bucket.MarshalKey(opts.Lower)
+		if err != nil {
+			it.Err = err
+			return
+		}
+		if lower := bucket.recordKey(k_b); bytes.Compare(lower, it.lower) > 0 {
+			it.lower = lower
+		}
+	}
+	if opts.Upper != nil {
+		k_b, err := bucket.MarshalKey(opts.Upper)
+		if err != nil {
+			it.Err = err
+			return
+		}
+		if upper := bucket.recordKey(k_b); it.upper == nil || bytes.Compare(upper, it.upper) < 0 {
+			it.upper = upper
+		}
+	}
 
-	return &it
+	it.Rewind()
 }
 
 func (it *BucketIter) Close() {
-	it.it.Close()
-	it.txn.Discard()
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	if it.txn != nil {
+		it.txn.Discard()
+		it.txn = nil
+	}
 }
 
+// Rewind moves to the first record of the range, the last one when
+// iterating in reverse.
 func (it *BucketIter) Rewind() {
-	it.it.Seek(it.prefix)
+	if it.Opts.Reverse {
+		seekBefore(it.it, it.upper)
+	} else {
+		it.it.Seek(it.lower)
+	}
+}
+
+// Seek moves to the record with key k, or to the next one in the
+// iteration order if there is none. It doesn't leave the range of the
+// iterator.
+func (it *BucketIter) Seek(k interface{}) error {
+	k_b, err := it.bucket.MarshalKey(k)
+	if err != nil {
+		it.Err = err
+		return err
+	}
+	key := it.bucket.recordKey(k_b)
+
+	switch {
+	case !it.Opts.Reverse && bytes.Compare(key, it.lower) < 0:
+		it.it.Seek(it.lower)
+	case it.Opts.Reverse && it.upper != nil && bytes.Compare(key, it.upper) >= 0:
+		seekBefore(it.it, it.upper)
+	default:
+		it.it.Seek(key)
+	}
+	return nil
 }
 
+// Valid reports whether the iterator is positioned on a record of its
+// range. It's false after an error.
 func (it *BucketIter) Valid() bool {
-	return it.it.ValidForPrefix(it.prefix)
+	if it.Err != nil || !it.it.Valid() {
+		return false
+	}
+	key := it.it.Key()
+	return bytes.Compare(key, it.lower) >= 0 && (it.upper == nil || bytes.Compare(key, it.upper) < 0)
 }
 
 func (it *BucketIter) EOF() bool {
-	return (! it.it.ValidForPrefix(it.prefix))
+	return (! it.Valid())
+}
+
+// Count returns the number of records from the current one to the end of
+// the range, leaving the iterator where it is.
+func (it *BucketIter) Count() (int, error) {
+	if !it.Valid() {
+		return 0, it.Err
+	}
+
+	current := append([]byte(nil), it.it.Key()...)
+	count := 0
+	for ; it.Valid(); it.it.Next() {
+		count++
+	}
+	it.it.Seek(current)
+	return count, nil
 }
 
 func (it *BucketIter) Next() {
@@ -75,59 +181,71 @@ func (it *BucketIter) Error() bool {
 	return it.Err != nil
 }
 
-func (it *BucketIter) Get(keyp *interface{}, valuep *interface{}) error {
-	item := it.it.Item()
-	k_prefixed := item.Key()
-	v_b, err := item.Value()
+// Key returns the key of the current record.
+func (it *BucketIter) Key() (interface{}, error) {
+	k_b := it.it.Key()[len(it.bucketPrefix):]
+
+	var k_i interface{}
+	err := it.bucket.UnmarshalKey(k_b, &k_i)
 	if err != nil {
 		it.Err = err
-		return err
+		return nil, err
 	}
+	return k_i, nil
+}
 
-	k_b := k_prefixed[len(it.prefix):]
+// Value returns the value of the current record. With KeysOnly, it's read
+// from the storage only now.
+func (it *BucketIter) Value() (interface{}, error) {
+	k_b := it.it.Key()[len(it.bucketPrefix):]
+	v_b, err := it.it.Value()
+	if err != nil {
+		it.Err = err
+		return nil, err
+	}
 
-	err = it.bucket.UnmarshalKey(k_b, keyp)
+	var v_i interface{}
+	err = it.bucket.decodeValue(it.txn, k_b, v_b, &v_i)
 	if err != nil {
 		it.Err = err
+		return nil, err
+	}
+	return v_i, nil
+}
+
+func (it *BucketIter) Get(keyp *interface{}, valuep *interface{}) error {
+	k_i, err := it.Key()
+	if err != nil {
 		return err
 	}
-	err = it.bucket.UnmarshalValue(v_b, valuep)
+	v_i, err := it.Value()
 	if err != nil {
-		it.Err = err
 		return err
 	}
 
+	*keyp = k_i
+	*valuep = v_i
 	return nil
 }
 
+// Find moves to the next record, from the current one, for which cmpFn
+// returns true, or whose value equals value if cmpFn is nil, and stores its
+// key in keyp. cmpFn can return Stop to end the search on the current
+// record, which is found if cmpFn returned true.
 func (it *BucketIter) Find(value interface{}, cmpFn BucketPredicate, keyp *interface{}) (bool, error) {
 	for ; it.Valid(); it.Next() {
-		item := it.it.Item()
-		k_prefixed := item.Key()
-		v_b, err := item.Value()
+		k_i, err := it.Key()
 		if err != nil {
-			it.Err = err
 			return false, err
 		}
-
-		k_b := k_prefixed[len(it.prefix):]
-
-		var k_i interface{}
-		var v_i interface{}
-		err = it.bucket.UnmarshalKey(k_b, &k_i)
+		v_i, err := it.Value()
 		if err != nil {
-			it.Err = err
-			return false, err
-		}
-		err = it.bucket.UnmarshalValue(v_b, &v_i)
-		if err != nil {
-			it.Err = err
 			return false, err
 		}
 
 		if cmpFn != nil {
 			found, err := cmpFn(it.bucket, k_i, v_i)
-			if err != nil {
+			if err != nil && err != Stop {
 				it.Err = err
 				return false, err
 			}
@@ -135,6 +253,9 @@ func (it *BucketIter) Find(value interface{}, cmpFn BucketPredicate, keyp *inter
 				*keyp = k_i
 				return true, nil
 			}
+			if err == Stop {
+				return false, nil
+			}
 		} else if v_i == value {
 			*keyp = k_i
 			return true, nil
@@ -0,0 +1,155 @@
+package puredb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBucketIterKeys(t *testing.T) {
+	forEachBackend(t, testBucketIterKeys)
+}
+
+func testBucketIterKeys(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntInt
+	opts.Compression = CompressionGzip
+	opts.UnmarshalValueFn = func(data []byte, v *interface{}) error {
+		return fmt.Errorf("value read")
+	}
+	db.AddBucket("numbers", opts)
+	bucket := db.GetBucket("numbers")
+	for i := int64(0); i < 5; i++ {
+		bucket.Set(i, i*10)
+	}
+
+	var keys []interface{}
+	err := bucket.IterateKeys(func(bucket *Bucket, k interface{}) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[0 1 2 3 4]" {
+		t.Fatalf("iterated keys %v - err:%v", keys, err)
+	}
+
+	it := NewBucketIter(bucket, BucketIterOpts{KeysOnly: true})
+	keys = nil
+	for ; it.Valid(); it.Next() {
+		k, err := it.Key()
+		if err != nil {
+			t.Fatalf("can't get key - err:%v", err)
+		}
+		keys = append(keys, k)
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[0 1 2 3 4]" {
+		t.Fatalf("keys %v", keys)
+	}
+
+	// values are still read on demand
+	bucket.UnmarshalValueFn = BucketOptsIntInt.UnmarshalValueFn
+	it = NewBucketIter(bucket, BucketIterOpts{KeysOnly: true, Prefix: i64tob(3)[:7]})
+	defer it.Close()
+	if !it.Valid() {
+		t.Fatalf("no records with prefix")
+	}
+	var k, v interface{}
+	if err := it.Get(&k, &v); err != nil || k != int64(0) || v != int64(0) {
+		t.Fatalf("got %v: %v - err:%v", k, v, err)
+	}
+	it.Next()
+	if v, err := it.Value(); err != nil || v != int64(10) {
+		t.Fatalf("got value %v - err:%v", v, err)
+	}
+}
+
+func TestBucketIterBounds(t *testing.T) {
+	forEachBackend(t, testBucketIterBounds)
+}
+
+func testBucketIterBounds(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("numbers", BucketOptsIntInt)
+	bucket := db.GetBucket("numbers")
+	// -1 is stored as eight 0xFF bytes, sorting last
+	for _, k := range []int64{0, 10, 20, 30, 40, -1} {
+		bucket.Set(k, k)
+	}
+	// a key right after the end of the bucket prefix
+	db.update(func(txn StorageTxn) error {
+		return txn.Set([]byte("numbers_`"), []byte("x"))
+	})
+
+	keys := func(it *BucketIter) string {
+		var keys []interface{}
+		for ; it.Valid(); it.Next() {
+			k, err := it.Key()
+			if err != nil {
+				t.Fatalf("can't get key - err:%v", err)
+			}
+			keys = append(keys, k)
+		}
+		if it.Err != nil {
+			t.Fatalf("iteration failed - err:%v", it.Err)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	it := NewBucketIter(bucket, BucketIterOpts{Reverse: true, PrefetchSize: 2})
+	defer it.Close()
+	if s := keys(it); s != "[-1 40 30 20 10 0]" {
+		t.Fatalf("reverse keys %v", s)
+	}
+
+	it.Reset(BucketIterOpts{Lower: int64(10), Upper: int64(40)})
+	if n, err := it.Count(); err != nil || n != 3 {
+		t.Fatalf("counted %d records - err:%v", n, err)
+	}
+	if s := keys(it); s != "[10 20 30]" {
+		t.Fatalf("bounded keys %v", s)
+	}
+	it.Seek(int64(15))
+	if s := keys(it); s != "[20 30]" {
+		t.Fatalf("keys after seek %v", s)
+	}
+	it.Seek(int64(5))
+	if s := keys(it); s != "[10 20 30]" {
+		t.Fatalf("keys after seek before the range %v", s)
+	}
+
+	it.Reset(BucketIterOpts{Reverse: true, Lower: int64(10), Upper: int64(40)})
+	if s := keys(it); s != "[30 20 10]" {
+		t.Fatalf("reverse bounded keys %v", s)
+	}
+	it.Seek(int64(25))
+	if n, _ := it.Count(); n != 2 {
+		t.Fatalf("counted %d records after reverse seek", n)
+	}
+	if s := keys(it); s != "[20 10]" {
+		t.Fatalf("keys after reverse seek %v", s)
+	}
+	it.Seek(int64(50))
+	if s := keys(it); s != "[30 20 10]" {
+		t.Fatalf("keys after reverse seek after the range %v", s)
+	}
+
+	// the reverse operations of the bucket see the last key
+	if k, _, err := bucket.Last(); err != nil || k != int64(-1) {
+		t.Fatalf("last key %v - err:%v", k, err)
+	}
+	if k, _, err := bucket.SearchOne(nil, func(*Bucket, interface{}, interface{}) (bool, error) { return true, nil }, true); err != nil || k != int64(-1) {
+		t.Fatalf("reverse search one found %v - err:%v", k, err)
+	}
+	if found, _, err := bucket.SearchAll(nil, func(*Bucket, interface{}, interface{}) (bool, error) { return true, nil }, true); err != nil || fmt.Sprint(found) != "[-1 40 30 20 10 0]" {
+		t.Fatalf("reverse search all found %v - err:%v", found, err)
+	}
+	if k, _, err := bucket.Pop(true); err != nil || k != int64(-1) {
+		t.Fatalf("popped %v - err:%v", k, err)
+	}
+	if k, _, err := bucket.Pop(true); err != nil || k != int64(40) {
+		t.Fatalf("popped %v - err:%v", k, err)
+	}
+}
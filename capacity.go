@@ -0,0 +1,176 @@
+package puredb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// capacityKey is the key of the record count and size of a capped bucket,
+// kept up to date by the writes so that eviction doesn't need a scan.
+func (bucket *Bucket) capacityKey() []byte {
+	return []byte(metaPrefix + "cap__" + bucket.Name)
+}
+
+// capped reports whether the bucket has MaxEntries or MaxBytes.
+func (bucket *Bucket) capped() bool {
+	return bucket.Opts.MaxEntries > 0 || bucket.Opts.MaxBytes > 0
+}
+
+// loadCapacity returns the number of records of a capped bucket and their
+// size.
+func (bucket *Bucket) loadCapacity(txn StorageTxn) (int64, int64, error) {
+	v_b, err := txn.Get(bucket.capacityKey())
+	if err == ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(v_b) != 16 {
+		return 0, 0, fmt.Errorf("puredb: invalid capacity record for bucket %q", bucket.Name)
+	}
+	return int64(binary.BigEndian.Uint64(v_b)), int64(binary.BigEndian.Uint64(v_b[8:])), nil
+}
+
+func (bucket *Bucket) saveCapacity(txn StorageTxn, entries int64, size int64) error {
+	return txn.Set(bucket.capacityKey(), append(u64tob(uint64(entries)), u64tob(uint64(size))...))
+}
+
+// trackCapacity updates the record count and size of a capped bucket for
+// the record with key k_b, about to be set to the encoded value v_b, or
+// deleted if v_b is nil. It must be called before writing the record.
+func (bucket *Bucket) trackCapacity(txn StorageTxn, k_b []byte, v_b []byte) error {
+	if !bucket.capped() {
+		return nil
+	}
+
+	entries, size, err := bucket.loadCapacity(txn)
+	if err != nil {
+		return err
+	}
+	old, err := txn.Get(bucket.recordKey(k_b))
+	switch {
+	case err == nil:
+		entries--
+		size -= int64(len(k_b) + len(old))
+	case err != ErrKeyNotFound:
+		return err
+	}
+	if v_b != nil {
+		entries++
+		size += int64(len(k_b) + len(v_b))
+	}
+	return bucket.saveCapacity(txn, entries, size)
+}
+
+// evict deletes the first records of a capped bucket, like Pop, until it
+// holds at most MaxEntries records of at most MaxBytes in total, keys
+// included. The record with key added, just written, is never evicted.
+// It returns the number of records deleted.
+func (bucket *Bucket) evict(txn StorageTxn, added []byte) (int, error) {
+	if !bucket.capped() {
+		return 0, nil
+	}
+	maxEntries, maxBytes := int64(bucket.Opts.MaxEntries), bucket.Opts.MaxBytes
+
+	entries, size, err := bucket.loadCapacity(txn)
+	if err != nil {
+		return 0, err
+	}
+	over := func() bool {
+		return (maxEntries > 0 && entries > maxEntries) || (maxBytes > 0 && size > maxBytes)
+	}
+	if !over() {
+		return 0, nil
+	}
+
+	// find the records to evict, then delete them once the iterator is
+	// closed
+	var victims [][]byte
+	added = bucket.recordKey(added)
+	err = func() error {
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		opts := defaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); over() && it.ValidForPrefix(prefix); it.Next() {
+			k_prefixed := it.Key()
+			if string(k_prefixed) == string(added) {
+				continue
+			}
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			k_b := append([]byte(nil), k_prefixed[len(prefix):]...)
+			victims = append(victims, k_b)
+			entries--
+			size -= int64(len(k_b) + len(v_b))
+		}
+		return nil
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k_b := range victims {
+		if err := bucket.reindex(txn, k_b, nil, true); err != nil {
+			return 0, err
+		}
+		if err := bucket.dropPending(txn, k_b); err != nil {
+			return 0, err
+		}
+		if err := txn.Delete(bucket.recordKey(k_b)); err != nil {
+			return 0, err
+		}
+	}
+	return len(victims), bucket.saveCapacity(txn, entries, size)
+}
+
+// setupCapacity counts the records of a capped bucket the first time it's
+// set up with MaxEntries or MaxBytes, and forgets the count of a bucket
+// that isn't capped anymore, which is not kept up to date.
+func (bucket *Bucket) setupCapacity() error {
+	db := bucket.DB
+	if db.readOnly {
+		return nil
+	}
+
+	var found bool
+	err := db.view(func(txn StorageTxn) error {
+		_, err := txn.Get(bucket.capacityKey())
+		found = err == nil
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil || found == bucket.capped() {
+		return err
+	}
+
+	return db.update(func(txn StorageTxn) error {
+		if !bucket.capped() {
+			return txn.Delete(bucket.capacityKey())
+		}
+
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		opts := defaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var entries, size int64
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			entries++
+			size += int64(len(it.Key()) - len(prefix) + len(v_b))
+		}
+		return bucket.saveCapacity(txn, entries, size)
+	})
+}
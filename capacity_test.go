@@ -0,0 +1,103 @@
+package puredb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCappedBucket(t *testing.T) {
+	forEachBackend(t, testCappedBucket)
+}
+
+func testCappedBucket(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	// records added before the bucket was capped are counted by Setup
+	db.AddBucket("events", BucketOptsIntInt)
+	bucket := db.GetBucket("events")
+	for i := 1; i <= 5; i++ {
+		bucket.Add(int64(i))
+	}
+	opts := BucketOptsIntInt
+	opts.MaxEntries = 10
+	if err := db.AddBucket("events", opts); err != nil {
+		t.Fatal("can't cap bucket", err)
+	}
+	bucket = db.GetBucket("events")
+
+	for i := 6; i <= 25; i++ {
+		if _, err := bucket.Add(int64(i)); err != nil {
+			t.Fatalf("can't add %d - err:%v", i, err)
+		}
+	}
+	if n, err := bucket.Count(); err != nil || n != 10 {
+		t.Fatalf("capped bucket holds %d records - err:%v", n, err)
+	}
+	if _, v, err := bucket.First(); err != nil || v != int64(16) {
+		t.Fatalf("first record is %v - err:%v", v, err)
+	}
+
+	// deletes and updates are counted too
+	k20, err := bucket.Search(int64(20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k18, err := bucket.Search(int64(18), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket.Delete(k20)
+	bucket.Set(k18, int64(180))
+	bucket.Add(int64(26))
+	if _, v, err := bucket.First(); err != nil || v != int64(16) {
+		t.Fatalf("first record is %v after a delete - err:%v", v, err)
+	}
+	bucket.Add(int64(27))
+	if _, v, err := bucket.First(); err != nil || v != int64(17) {
+		t.Fatalf("first record is %v after an eviction - err:%v", v, err)
+	}
+	if n, err := bucket.Count(); err != nil || n != 10 {
+		t.Fatalf("capped bucket holds %d records - err:%v", n, err)
+	}
+
+	opts = BucketOptsIntJSON
+	opts.MaxBytes = 1000
+	db.AddBucket("logs", opts)
+	bucket = db.GetBucket("logs")
+	line := strings.Repeat("x", 100)
+	for i := 0; i < 50; i++ {
+		if _, err := bucket.Add(line); err != nil {
+			t.Fatalf("can't add line %d - err:%v", i, err)
+		}
+	}
+	size := int64(0)
+	n := 0
+	err = db.view(func(txn StorageTxn) error {
+		prefix := []byte("logs__")
+		it := txn.NewIterator(defaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			size += int64(len(it.Key()) - len(prefix) + len(v_b))
+			n++
+		}
+		entries, counted, err := bucket.loadCapacity(txn)
+		if err == nil && (entries != int64(n) || counted != size) {
+			t.Errorf("capacity record says %d records, %d bytes, not %d, %d", entries, counted, n, size)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size > 1000 || n < 5 {
+		t.Fatalf("bucket capped at 1000 bytes holds %d records, %d bytes", n, size)
+	}
+	if n, err := bucket.Count(); err != nil || n != 9 {
+		t.Fatalf("bucket capped at 1000 bytes holds %d records - err:%v", n, err)
+	}
+}
@@ -0,0 +1,833 @@
+package puredb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrListEmpty is returned when popping from an empty list.
+var ErrListEmpty = errors.New("puredb: list is empty")
+
+// The kinds of collections, starting the keys of their elements.
+const (
+	collectionList      = 'l'
+	collectionSet       = 's'
+	collectionSortedSet = 'z' // members by score
+	collectionHash      = 'h'
+)
+
+// collection holds what the collection types have in common: they are
+// named groups of records of a bucket, one per element, whose keys start
+// with the kind of the collection and its escaped name, like index
+// values, so that the elements of a collection are contiguous.
+//
+// The values of the elements are marshaled with the value codecs of the
+// bucket. A bucket holding collections shouldn't hold other records, nor
+// have Indexes or a MergeFn.
+type collection struct {
+	bucket *Bucket
+	name   string
+	prefix []byte
+}
+
+func newCollection(bucket *Bucket, kind byte, name string) collection {
+	return collection{
+		bucket: bucket,
+		name:   name,
+		prefix: appendIndexBytes([]byte{kind}, []byte(name)),
+	}
+}
+
+// key returns the key of the element of the collection with key sub,
+// unprefixed like the keys passed to MarshalKeyFn.
+func (c collection) key(sub []byte) []byte {
+	k_b := make([]byte, 0, len(c.prefix)+len(sub))
+	k_b = append(k_b, c.prefix...)
+	return append(k_b, sub...)
+}
+
+// update runs fn in a read-write transaction, retrying it on conflicts.
+func (c collection) update(op string, fn func(txn StorageTxn) error) error {
+	db := c.bucket.DB
+	start := time.Now()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	var err error
+	for {
+		err = db.update(fn)
+		if err != ErrConflict {
+			break
+		}
+	}
+	db.logger.Debug("puredb: "+op, "bucket", c.bucket.Name, "collection", c.name, "duration", time.Since(start), "err", err)
+	return err
+}
+
+// view runs fn in a read-only transaction.
+func (c collection) view(op string, fn func(txn StorageTxn) error) error {
+	db := c.bucket.DB
+	start := time.Now()
+
+	err := db.view(fn)
+	db.logger.Debug("puredb: "+op, "bucket", c.bucket.Name, "collection", c.name, "duration", time.Since(start), "err", err)
+	return err
+}
+
+// put sets the element with key k_b to the encoded value v_b.
+func (c collection) put(txn StorageTxn, k_b []byte, v_b []byte) error {
+	if err := c.bucket.trackCapacity(txn, k_b, v_b); err != nil {
+		return err
+	}
+	return txn.Set(c.bucket.recordKey(k_b), v_b)
+}
+
+// remove deletes the element with key k_b, reporting whether there was
+// one.
+func (c collection) remove(txn StorageTxn, k_b []byte) (bool, error) {
+	_, err := txn.Get(c.bucket.recordKey(k_b))
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := c.bucket.trackCapacity(txn, k_b, nil); err != nil {
+		return false, err
+	}
+	return true, txn.Delete(c.bucket.recordKey(k_b))
+}
+
+// get returns the decoded value of the element with key k_b, or
+// ErrKeyNotFound.
+func (c collection) get(txn StorageTxn, k_b []byte) (interface{}, error) {
+	v_b, err := txn.Get(c.bucket.recordKey(k_b))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = c.bucket.decodeValue(txn, k_b, v_b, &v)
+	return v, err
+}
+
+// scan calls fn with the keys and the encoded values of the elements whose
+// keys start with the collection prefix followed by sub, from the one with
+// key from if not nil, in key order or in reverse, until fn returns
+// false.
+func (c collection) scan(txn StorageTxn, sub []byte, from []byte, reverse bool, fn func(k_b []byte, v_b []byte) (bool, error)) error {
+	prefix := c.bucket.recordKey(c.key(sub))
+	bucketPrefix := len(c.bucket.recordKey(nil))
+
+	opts := defaultIteratorOptions
+	opts.PrefetchSize = 10
+	opts.Reverse = reverse
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	switch {
+	case from != nil:
+		it.Seek(c.bucket.recordKey(from))
+	case reverse:
+		seekBefore(it, prefixEnd(prefix))
+	default:
+		it.Seek(prefix)
+	}
+	for ; it.ValidForPrefix(prefix); it.Next() {
+		v_b, err := it.Value()
+		if err != nil {
+			return err
+		}
+		more, err := fn(it.Key()[bucketPrefix:], v_b)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// count returns the number of elements whose keys start with the
+// collection prefix followed by sub.
+func (c collection) count(txn StorageTxn, sub []byte) (int, error) {
+	prefix := c.bucket.recordKey(c.key(sub))
+
+	opts := defaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	n := 0
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		n++
+	}
+	return n, nil
+}
+
+// rangeBounds converts the inclusive indexes start and stop, counted from
+// the end if negative, into the bounds of a slice of n elements.
+func rangeBounds(start int, stop int, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+// List is a list of values, which can be pushed and popped at both ends.
+// Its elements are keyed by their position, so Len and Range don't need
+// to walk the list.
+type List struct {
+	collection
+}
+
+// NewList returns the list named name of bucket.
+func NewList(bucket *Bucket, name string) *List {
+	return &List{newCollection(bucket, collectionList, name)}
+}
+
+func listPosition(pos int64) []byte {
+	// flip the sign bit, so that negative positions sort first
+	return u64tob(uint64(pos) ^ 1<<63)
+}
+
+// ends returns the positions of the first and the last element of the
+// list, and its length.
+func (l *List) ends(txn StorageTxn) (int64, int64, int, error) {
+	var first, last int64
+	n := 0
+	for _, reverse := range []bool{false, true} {
+		err := l.scan(txn, nil, nil, reverse, func(k_b []byte, v_b []byte) (bool, error) {
+			pos := int64(binary.BigEndian.Uint64(k_b[len(l.prefix):]) ^ 1<<63)
+			if reverse {
+				last = pos
+			} else {
+				first = pos
+			}
+			n = 1
+			return false, nil
+		})
+		if err != nil || n == 0 {
+			return 0, 0, 0, err
+		}
+	}
+	return first, last, int(last-first) + 1, nil
+}
+
+// PushLeft adds the values at the start of the list, one after the other,
+// so that the last one ends up first, and returns the new length.
+func (l *List) PushLeft(values ...interface{}) (int, error) {
+	return l.push(values, true)
+}
+
+// PushRight adds the values at the end of the list, and returns the new
+// length.
+func (l *List) PushRight(values ...interface{}) (int, error) {
+	return l.push(values, false)
+}
+
+func (l *List) push(values []interface{}, left bool) (int, error) {
+	n := 0
+	err := l.update("list push", func(txn StorageTxn) error {
+		first, last, length, err := l.ends(txn)
+		if err != nil {
+			return err
+		}
+		if length == 0 {
+			first, last = 0, -1
+		}
+		for _, v := range values {
+			var pos int64
+			if left {
+				first--
+				pos = first
+			} else {
+				last++
+				pos = last
+			}
+			k_b := l.key(listPosition(pos))
+			v_b, err := l.bucket.encodeValue(txn, k_b, v)
+			if err != nil {
+				return err
+			}
+			if err := l.put(txn, k_b, v_b); err != nil {
+				return err
+			}
+		}
+		n = length + len(values)
+		return nil
+	})
+	return n, err
+}
+
+// PopLeft removes and returns the first value of the list, or
+// ErrListEmpty.
+func (l *List) PopLeft() (interface{}, error) {
+	return l.pop(true)
+}
+
+// PopRight removes and returns the last value of the list, or
+// ErrListEmpty.
+func (l *List) PopRight() (interface{}, error) {
+	return l.pop(false)
+}
+
+func (l *List) pop(left bool) (interface{}, error) {
+	var v interface{}
+	err := l.update("list pop", func(txn StorageTxn) error {
+		first, last, length, err := l.ends(txn)
+		if err != nil {
+			return err
+		}
+		if length == 0 {
+			return ErrListEmpty
+		}
+		pos := last
+		if left {
+			pos = first
+		}
+		k_b := l.key(listPosition(pos))
+		if v, err = l.get(txn, k_b); err != nil {
+			return err
+		}
+		_, err = l.remove(txn, k_b)
+		return err
+	})
+	return v, err
+}
+
+// Range returns the values from index start to index stop included,
+// counted from the end of the list if negative, like in Redis.
+func (l *List) Range(start int, stop int) ([]interface{}, error) {
+	var values []interface{}
+	err := l.view("list range", func(txn StorageTxn) error {
+		first, _, length, err := l.ends(txn)
+		if err != nil {
+			return err
+		}
+		start, end := rangeBounds(start, stop, length)
+		if start == end {
+			return nil
+		}
+		from := l.key(listPosition(first + int64(start)))
+		return l.scan(txn, nil, from, false, func(k_b []byte, v_b []byte) (bool, error) {
+			var v interface{}
+			if err := l.bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return false, err
+			}
+			values = append(values, v)
+			return len(values) < end-start, nil
+		})
+	})
+	return values, err
+}
+
+// Len returns the number of values in the list.
+func (l *List) Len() (int, error) {
+	n := 0
+	err := l.view("list len", func(txn StorageTxn) error {
+		var err error
+		_, _, n, err = l.ends(txn)
+		return err
+	})
+	return n, err
+}
+
+// Set is a set of values. Members are compared like index values, so they
+// can be nil, booleans, numbers, strings, byte slices or times, and the
+// numbers 1 and 1.0 are the same member.
+type Set struct {
+	collection
+}
+
+// NewSet returns the set named name of bucket.
+func NewSet(bucket *Bucket, name string) *Set {
+	return &Set{newCollection(bucket, collectionSet, name)}
+}
+
+// Add adds the members to the set, and returns how many were not there.
+func (s *Set) Add(members ...interface{}) (int, error) {
+	added := 0
+	err := s.update("set add", func(txn StorageTxn) error {
+		added = 0
+		for _, member := range members {
+			enc, err := encodeIndexValue(member)
+			if err != nil {
+				return err
+			}
+			k_b := s.key(enc)
+			_, err = txn.Get(s.bucket.recordKey(k_b))
+			switch {
+			case err == nil:
+				continue
+			case err != ErrKeyNotFound:
+				return err
+			}
+			v_b, err := s.bucket.encodeValue(txn, k_b, member)
+			if err != nil {
+				return err
+			}
+			if err := s.put(txn, k_b, v_b); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	return added, err
+}
+
+// Remove removes the members from the set, and returns how many were
+// there.
+func (s *Set) Remove(members ...interface{}) (int, error) {
+	removed := 0
+	err := s.update("set remove", func(txn StorageTxn) error {
+		removed = 0
+		for _, member := range members {
+			enc, err := encodeIndexValue(member)
+			if err != nil {
+				return err
+			}
+			found, err := s.remove(txn, s.key(enc))
+			if err != nil {
+				return err
+			}
+			if found {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Has reports whether member is in the set.
+func (s *Set) Has(member interface{}) (bool, error) {
+	found := false
+	err := s.view("set has", func(txn StorageTxn) error {
+		var err error
+		found, err = s.has(txn, member)
+		return err
+	})
+	return found, err
+}
+
+func (s *Set) has(txn StorageTxn, member interface{}) (bool, error) {
+	enc, err := encodeIndexValue(member)
+	if err != nil {
+		return false, err
+	}
+	_, err = txn.Get(s.bucket.recordKey(s.key(enc)))
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Members returns the members of the set, in index order.
+func (s *Set) Members() ([]interface{}, error) {
+	return s.Intersect()
+}
+
+// Intersect returns the members of the set which are also members of all
+// the others, in index order. The other sets can belong to other buckets
+// of the same database.
+func (s *Set) Intersect(others ...*Set) ([]interface{}, error) {
+	var members []interface{}
+	err := s.view("set intersect", func(txn StorageTxn) error {
+		return s.scan(txn, nil, nil, false, func(k_b []byte, v_b []byte) (bool, error) {
+			var member interface{}
+			if err := s.bucket.decodeValue(txn, k_b, v_b, &member); err != nil {
+				return false, err
+			}
+			for _, other := range others {
+				found, err := other.has(txn, member)
+				if err != nil || !found {
+					return err == nil, err
+				}
+			}
+			members = append(members, member)
+			return true, nil
+		})
+	})
+	return members, err
+}
+
+// Len returns the number of members of the set. It walks the set.
+func (s *Set) Len() (int, error) {
+	n := 0
+	err := s.view("set len", func(txn StorageTxn) error {
+		var err error
+		n, err = s.count(txn, nil)
+		return err
+	})
+	return n, err
+}
+
+// ScoredMember is a member of a SortedSet, with its score.
+type ScoredMember struct {
+	Member interface{}
+	Score  float64
+}
+
+// SortedSet is a set of values ordered by score, then like index values.
+// Its elements are keyed by score, to walk the set in order, and the score
+// of each member is kept aside, in PureDB's own records, to look it up,
+// along with the number of members. Ranks are found by walking the set up
+// to them.
+//
+// Since the number of members is updated by every Add and Remove,
+// concurrent ones conflict, and are retried.
+type SortedSet struct {
+	collection
+}
+
+// NewSortedSet returns the sorted set named name of bucket.
+func NewSortedSet(bucket *Bucket, name string) *SortedSet {
+	return &SortedSet{newCollection(bucket, collectionSortedSet, name)}
+}
+
+// scoreKey returns the key of member, encoded as enc, in the set by score.
+func (z *SortedSet) scoreKey(score float64, enc []byte) []byte {
+	return z.key(append(encodeIndexNumber(score, 0), enc...))
+}
+
+// memberKey returns the key of the score of the member encoded as enc.
+// Scores aren't values of the bucket, so they are kept out of its records
+// and of the conversions of its values.
+func (z *SortedSet) memberKey(enc []byte) []byte {
+	return append([]byte(metaPrefix+"zscore__"+z.bucket.Name+"__"), z.key(enc)...)
+}
+
+// lenKey returns the key of the number of members of the set.
+func (z *SortedSet) lenKey() []byte {
+	return append([]byte(metaPrefix+"zlen__"+z.bucket.Name+"__"), z.prefix...)
+}
+
+// len returns the number of members of the set.
+func (z *SortedSet) len(txn StorageTxn) (int, error) {
+	v_b, err := txn.Get(z.lenKey())
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := btoi64(v_b)
+	if err != nil {
+		return 0, fmt.Errorf("puredb: invalid length of sorted set %q", z.name)
+	}
+	return int(n), nil
+}
+
+// addLen adds delta to the number of members of the set.
+func (z *SortedSet) addLen(txn StorageTxn, delta int) error {
+	n, err := z.len(txn)
+	if err != nil {
+		return err
+	}
+	return txn.Set(z.lenKey(), i64tob(int64(n+delta)))
+}
+
+// score returns the score of the member encoded as enc, or
+// ErrKeyNotFound.
+func (z *SortedSet) score(txn StorageTxn, enc []byte) (float64, error) {
+	v_b, err := txn.Get(z.memberKey(enc))
+	if err != nil {
+		return 0, err
+	}
+	if len(v_b) != 8 {
+		return 0, fmt.Errorf("puredb: invalid score in sorted set %q", z.name)
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(v_b)), nil
+}
+
+// Add adds member to the set with the given score, or changes its score
+// if it's there, reporting whether it was added.
+func (z *SortedSet) Add(member interface{}, score float64) (bool, error) {
+	added := false
+	err := z.update("sorted set add", func(txn StorageTxn) error {
+		var err error
+		added, err = z.set(txn, member, func(float64) float64 { return score })
+		return err
+	})
+	return added, err
+}
+
+// Incr adds delta to the score of member, added with a score of delta if
+// it's not in the set, and returns the new score.
+func (z *SortedSet) Incr(member interface{}, delta float64) (float64, error) {
+	var score float64
+	err := z.update("sorted set incr", func(txn StorageTxn) error {
+		_, err := z.set(txn, member, func(old float64) float64 {
+			score = old + delta
+			return score
+		})
+		return err
+	})
+	return score, err
+}
+
+// set sets the score of member to what fn returns for its current one, 0
+// if it's not in the set, reporting whether it was added.
+func (z *SortedSet) set(txn StorageTxn, member interface{}, fn func(old float64) float64) (bool, error) {
+	enc, err := encodeIndexValue(member)
+	if err != nil {
+		return false, err
+	}
+	old, err := z.score(txn, enc)
+	found := err == nil
+	if err != nil && err != ErrKeyNotFound {
+		return false, err
+	}
+
+	score := fn(old)
+	if found {
+		if _, err := z.remove(txn, z.scoreKey(old, enc)); err != nil {
+			return false, err
+		}
+	} else if err := z.addLen(txn, 1); err != nil {
+		return false, err
+	}
+	k_b := z.scoreKey(score, enc)
+	v_b, err := z.bucket.encodeValue(txn, k_b, member)
+	if err != nil {
+		return false, err
+	}
+	if err := z.put(txn, k_b, v_b); err != nil {
+		return false, err
+	}
+	return !found, txn.Set(z.memberKey(enc), u64tob(math.Float64bits(score)))
+}
+
+// Remove removes member from the set, reporting whether it was there.
+func (z *SortedSet) Remove(member interface{}) (bool, error) {
+	found := false
+	err := z.update("sorted set remove", func(txn StorageTxn) error {
+		enc, err := encodeIndexValue(member)
+		if err != nil {
+			return err
+		}
+		score, err := z.score(txn, enc)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		if _, err := z.remove(txn, z.scoreKey(score, enc)); err != nil {
+			return err
+		}
+		if err := z.addLen(txn, -1); err != nil {
+			return err
+		}
+		return txn.Delete(z.memberKey(enc))
+	})
+	return found, err
+}
+
+// Score returns the score of member, or ErrKeyNotFound.
+func (z *SortedSet) Score(member interface{}) (float64, error) {
+	var score float64
+	err := z.view("sorted set score", func(txn StorageTxn) error {
+		enc, err := encodeIndexValue(member)
+		if err != nil {
+			return err
+		}
+		score, err = z.score(txn, enc)
+		return err
+	})
+	return score, err
+}
+
+// Rank returns the rank of member, from 0 for the lowest score, or
+// ErrKeyNotFound. It walks the set up to member, so it takes time
+// proportional to the rank.
+func (z *SortedSet) Rank(member interface{}) (int, error) {
+	rank := 0
+	err := z.view("sorted set rank", func(txn StorageTxn) error {
+		enc, err := encodeIndexValue(member)
+		if err != nil {
+			return err
+		}
+		score, err := z.score(txn, enc)
+		if err != nil {
+			return err
+		}
+		key := z.scoreKey(score, enc)
+		return z.scan(txn, nil, nil, false, func(k_b []byte, v_b []byte) (bool, error) {
+			if bytes.Equal(k_b, key) {
+				return false, nil
+			}
+			rank++
+			return true, nil
+		})
+	})
+	return rank, err
+}
+
+// Range returns the members from rank start to rank stop included, counted
+// from the end if negative, like in Redis. With reverse, ranks are counted
+// from the highest score.
+func (z *SortedSet) Range(start int, stop int, reverse bool) ([]ScoredMember, error) {
+	var members []ScoredMember
+	err := z.view("sorted set range", func(txn StorageTxn) error {
+		n, err := z.len(txn)
+		if err != nil {
+			return err
+		}
+		start, end := rangeBounds(start, stop, n)
+		rank := 0
+		return z.scan(txn, nil, nil, reverse, func(k_b []byte, v_b []byte) (bool, error) {
+			if rank >= end {
+				return false, nil
+			}
+			rank++
+			if rank <= start {
+				return true, nil
+			}
+			m, err := z.scoredMember(txn, k_b, v_b)
+			members = append(members, m)
+			return err == nil, err
+		})
+	})
+	return members, err
+}
+
+// RangeByScore returns the members with a score from min to max included,
+// by increasing score.
+func (z *SortedSet) RangeByScore(min float64, max float64) ([]ScoredMember, error) {
+	var members []ScoredMember
+	err := z.view("sorted set range by score", func(txn StorageTxn) error {
+		from := z.key(encodeIndexNumber(min, 0))
+		return z.scan(txn, nil, from, false, func(k_b []byte, v_b []byte) (bool, error) {
+			m, err := z.scoredMember(txn, k_b, v_b)
+			if err != nil || m.Score > max {
+				return false, err
+			}
+			members = append(members, m)
+			return true, nil
+		})
+	})
+	return members, err
+}
+
+// scoredMember decodes the element of the set by score with key k_b.
+func (z *SortedSet) scoredMember(txn StorageTxn, k_b []byte, v_b []byte) (ScoredMember, error) {
+	var m ScoredMember
+	bits := binary.BigEndian.Uint64(k_b[len(z.prefix)+1:])
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	m.Score = math.Float64frombits(bits)
+	err := z.bucket.decodeValue(txn, k_b, v_b, &m.Member)
+	return m, err
+}
+
+// Len returns the number of members of the set.
+func (z *SortedSet) Len() (int, error) {
+	n := 0
+	err := z.view("sorted set len", func(txn StorageTxn) error {
+		var err error
+		n, err = z.len(txn)
+		return err
+	})
+	return n, err
+}
+
+// Hash maps string fields to values, each stored as an element of its
+// own, so that fields are read and written one at a time.
+type Hash struct {
+	collection
+}
+
+// NewHash returns the hash named name of bucket.
+func NewHash(bucket *Bucket, name string) *Hash {
+	return &Hash{newCollection(bucket, collectionHash, name)}
+}
+
+// Get returns the value of field, or ErrKeyNotFound.
+func (h *Hash) Get(field string) (interface{}, error) {
+	var v interface{}
+	err := h.view("hash get", func(txn StorageTxn) error {
+		var err error
+		v, err = h.get(txn, h.key([]byte(field)))
+		return err
+	})
+	return v, err
+}
+
+// Set sets field to v.
+func (h *Hash) Set(field string, v interface{}) error {
+	return h.update("hash set", func(txn StorageTxn) error {
+		k_b := h.key([]byte(field))
+		v_b, err := h.bucket.encodeValue(txn, k_b, v)
+		if err != nil {
+			return err
+		}
+		return h.put(txn, k_b, v_b)
+	})
+}
+
+// Delete removes the fields, and returns how many there were.
+func (h *Hash) Delete(fields ...string) (int, error) {
+	removed := 0
+	err := h.update("hash delete", func(txn StorageTxn) error {
+		removed = 0
+		for _, field := range fields {
+			found, err := h.remove(txn, h.key([]byte(field)))
+			if err != nil {
+				return err
+			}
+			if found {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// GetAll returns the fields of the hash and their values.
+func (h *Hash) GetAll() (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	err := h.view("hash get all", func(txn StorageTxn) error {
+		return h.scan(txn, nil, nil, false, func(k_b []byte, v_b []byte) (bool, error) {
+			var v interface{}
+			if err := h.bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return false, err
+			}
+			fields[string(k_b[len(h.prefix):])] = v
+			return true, nil
+		})
+	})
+	return fields, err
+}
+
+// Len returns the number of fields of the hash. It walks the hash.
+func (h *Hash) Len() (int, error) {
+	n := 0
+	err := h.view("hash len", func(txn StorageTxn) error {
+		var err error
+		n, err = h.count(txn, nil)
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,176 @@
+package puredb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestCollections(t *testing.T) {
+	forEachBackend(t, testCollections)
+}
+
+func testCollections(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntInt
+	opts.MarshalValueFn = func(v interface{}) ([]byte, error) {
+		return msgpack.Marshal(v)
+	}
+	opts.UnmarshalValueFn = func(data []byte, v *interface{}) error {
+		return msgpack.Unmarshal(data, v)
+	}
+	db.AddBucket("cache", opts)
+	bucket := db.GetBucket("cache")
+
+	// lists
+	l := NewList(bucket, "jobs")
+	if _, err := l.PopLeft(); err != ErrListEmpty {
+		t.Fatalf("popped from empty list - err:%v", err)
+	}
+	l.PushRight("c", "d")
+	if n, err := l.PushLeft("b", "a"); err != nil || n != 4 {
+		t.Fatalf("list length %d after push - err:%v", n, err)
+	}
+	l.PushRight("e")
+	if values, err := l.Range(0, -1); err != nil || fmt.Sprint(values) != "[a b c d e]" {
+		t.Fatalf("list holds %v - err:%v", values, err)
+	}
+	if values, err := l.Range(1, -2); err != nil || fmt.Sprint(values) != "[b c d]" {
+		t.Fatalf("list range is %v - err:%v", values, err)
+	}
+	if values, err := l.Range(3, 1); err != nil || len(values) != 0 {
+		t.Fatalf("empty list range is %v - err:%v", values, err)
+	}
+	if v, err := l.PopLeft(); err != nil || v != "a" {
+		t.Fatalf("popped %v from the left - err:%v", v, err)
+	}
+	if v, err := l.PopRight(); err != nil || v != "e" {
+		t.Fatalf("popped %v from the right - err:%v", v, err)
+	}
+	if n, err := l.Len(); err != nil || n != 3 {
+		t.Fatalf("list length %d - err:%v", n, err)
+	}
+	// another list with a name starting like the first one
+	other := NewList(bucket, "jobs2")
+	other.PushRight("x")
+	if n, _ := l.Len(); n != 3 {
+		t.Fatalf("list length %d after pushing to another one", n)
+	}
+
+	// sets
+	s := NewSet(bucket, "tags")
+	if n, err := s.Add("go", "db", "kv", "go"); err != nil || n != 3 {
+		t.Fatalf("added %d members - err:%v", n, err)
+	}
+	if found, err := s.Has("db"); err != nil || !found {
+		t.Fatalf("member not found - err:%v", err)
+	}
+	if n, err := s.Remove("db", "sql"); err != nil || n != 1 {
+		t.Fatalf("removed %d members - err:%v", n, err)
+	}
+	if members, err := s.Members(); err != nil || fmt.Sprint(members) != "[go kv]" {
+		t.Fatalf("set holds %v - err:%v", members, err)
+	}
+	s2 := NewSet(bucket, "langs")
+	s2.Add("go", "rust")
+	if members, err := s.Intersect(s2); err != nil || fmt.Sprint(members) != "[go]" {
+		t.Fatalf("intersection is %v - err:%v", members, err)
+	}
+	if n, err := s.Len(); err != nil || n != 2 {
+		t.Fatalf("set length %d - err:%v", n, err)
+	}
+
+	// sorted sets
+	z := NewSortedSet(bucket, "scores")
+	for member, score := range map[string]float64{"ann": 10, "bob": -2.5, "cid": 7, "dan": 7} {
+		if added, err := z.Add(member, score); err != nil || !added {
+			t.Fatalf("can't add %s - err:%v", member, err)
+		}
+	}
+	if added, err := z.Add("bob", 12); err != nil || added {
+		t.Fatalf("score update added a member - err:%v", err)
+	}
+	if score, err := z.Incr("cid", 0.5); err != nil || score != 7.5 {
+		t.Fatalf("incremented score is %v - err:%v", score, err)
+	}
+	if score, err := z.Score("bob"); err != nil || score != 12 {
+		t.Fatalf("score is %v - err:%v", score, err)
+	}
+	if _, err := z.Score("eve"); err != ErrKeyNotFound {
+		t.Fatalf("score of a missing member - err:%v", err)
+	}
+	if rank, err := z.Rank("ann"); err != nil || rank != 2 {
+		t.Fatalf("rank is %d - err:%v", rank, err)
+	}
+	members, err := z.Range(0, -1, false)
+	if err != nil || fmt.Sprint(members) != "[{dan 7} {cid 7.5} {ann 10} {bob 12}]" {
+		t.Fatalf("sorted set holds %v - err:%v", members, err)
+	}
+	members, err = z.Range(0, 1, true)
+	if err != nil || fmt.Sprint(members) != "[{bob 12} {ann 10}]" {
+		t.Fatalf("top members are %v - err:%v", members, err)
+	}
+	members, err = z.RangeByScore(7.5, 10)
+	if err != nil || fmt.Sprint(members) != "[{cid 7.5} {ann 10}]" {
+		t.Fatalf("members by score are %v - err:%v", members, err)
+	}
+	if found, err := z.Remove("ann"); err != nil || !found {
+		t.Fatalf("can't remove - err:%v", err)
+	}
+	if n, err := z.Len(); err != nil || n != 3 {
+		t.Fatalf("sorted set length %d - err:%v", n, err)
+	}
+	z.Remove("ann")
+	z.Incr("eve", 1)
+	if n, err := z.Len(); err != nil || n != 4 {
+		t.Fatalf("sorted set length %d after incr - err:%v", n, err)
+	}
+	if n, err := NewSortedSet(bucket, "other").Len(); err != nil || n != 0 {
+		t.Fatalf("empty sorted set length %d - err:%v", n, err)
+	}
+
+	// scores don't get in the way of the values of framed buckets
+	framed := opts
+	framed.Compression = CompressionSnappy
+	framed.SchemaVersion = 1
+	db.AddBucket("ranked", framed)
+	ranked := db.GetBucket("ranked")
+	z = NewSortedSet(ranked, "scores")
+	z.Add("ann", 1)
+	z.Add("bob", 2)
+	if stats, err := ranked.Stats(); err != nil || stats.Count != 2 {
+		t.Fatalf("framed bucket stats %+v - err:%v", stats, err)
+	}
+	if _, err := ranked.Migrate(context.Background()); err != nil {
+		t.Fatalf("can't migrate framed bucket - err:%v", err)
+	}
+	if score, err := z.Score("bob"); err != nil || score != 2 {
+		t.Fatalf("score in framed bucket is %v - err:%v", score, err)
+	}
+
+	// hashes
+	h := NewHash(bucket, "user:1")
+	h.Set("name", "ann")
+	h.Set("email", "ann@example.com")
+	if v, err := h.Get("name"); err != nil || v != "ann" {
+		t.Fatalf("field is %v - err:%v", v, err)
+	}
+	if _, err := h.Get("phone"); err != ErrKeyNotFound {
+		t.Fatalf("missing field - err:%v", err)
+	}
+	if n, err := h.Delete("email", "phone"); err != nil || n != 1 {
+		t.Fatalf("deleted %d fields - err:%v", n, err)
+	}
+	fields, err := h.GetAll()
+	if err != nil || !reflect.DeepEqual(fields, map[string]interface{}{"name": "ann"}) {
+		t.Fatalf("hash holds %v - err:%v", fields, err)
+	}
+	if n, err := h.Len(); err != nil || n != 1 {
+		t.Fatalf("hash length %d - err:%v", n, err)
+	}
+}
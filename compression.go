@@ -0,0 +1,128 @@
+package puredb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Compression selects how a bucket compresses its values. Values are
+// compressed after MarshalValueFn and decompressed before UnmarshalValueFn.
+type Compression byte
+
+const (
+	// CompressionNone stores values uncompressed. It's the default, and
+	// the values compressed before it was set stay readable.
+	CompressionNone Compression = iota
+	// CompressionFlate uses compress/flate (RFC 1951).
+	CompressionFlate
+	// CompressionGzip uses compress/gzip (RFC 1952).
+	CompressionGzip
+	// CompressionSnappy uses the Snappy block format, with
+	// github.com/golang/snappy: much faster than flate, with a lower
+	// compression ratio.
+	CompressionSnappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Compression(%d)", byte(c))
+}
+
+// compressionCodec identifies the codec of a value in its header byte.
+type compressionCodec byte
+
+const (
+	codecStored compressionCodec = iota
+	codecFlate
+	codecGzip
+	codecSnappy
+)
+
+func (c Compression) codec() (compressionCodec, error) {
+	switch c {
+	case CompressionFlate:
+		return codecFlate, nil
+	case CompressionGzip:
+		return codecGzip, nil
+	case CompressionSnappy:
+		return codecSnappy, nil
+	}
+	return codecStored, fmt.Errorf("puredb: unknown compression %v", c)
+}
+
+// compress returns data compressed with codec, or data as-is and
+// codecStored if compressing doesn't make it smaller.
+func compress(codec compressionCodec, data []byte) ([]byte, compressionCodec, error) {
+	var out []byte
+	switch codec {
+	case codecStored:
+		return data, codecStored, nil
+	case codecFlate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, codec, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, codec, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, codec, err
+		}
+		out = buf.Bytes()
+	case codecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, codec, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, codec, err
+		}
+		out = buf.Bytes()
+	case codecSnappy:
+		out = snappy.Encode(nil, data)
+	default:
+		return nil, codec, fmt.Errorf("puredb: unknown compression codec %d", codec)
+	}
+
+	if len(out) >= len(data) {
+		return data, codecStored, nil
+	}
+	return out, codec, nil
+}
+
+func decompress(codec compressionCodec, data []byte) ([]byte, error) {
+	switch codec {
+	case codecStored:
+		return data, nil
+	case codecFlate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case codecSnappy:
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("puredb: unknown compression codec %d", codec)
+}
@@ -0,0 +1,168 @@
+package puredb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var BucketOptsIntJSON = BucketOpts{
+	MarshalKeyFn:   BucketOptsIntInt.MarshalKeyFn,
+	UnmarshalKeyFn: BucketOptsIntInt.UnmarshalKeyFn,
+	MarshalValueFn: func(v interface{}) ([]byte, error) {
+		return json.Marshal(v)
+	},
+	UnmarshalValueFn: func(data []byte, v *interface{}) error {
+		var m map[string]interface{}
+		err := json.Unmarshal(data, &m)
+		*v = m
+		return err
+	},
+}
+
+func TestCompression(t *testing.T) {
+	forEachBackend(t, testCompression)
+}
+
+func testCompression(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	doc := map[string]interface{}{
+		"title":       "Much Ado About Nothing",
+		"description": strings.Repeat("a comedy by William Shakespeare, ", 20),
+	}
+
+	for _, compression := range []Compression{CompressionFlate, CompressionGzip, CompressionSnappy} {
+		opts := BucketOptsIntJSON
+		opts.Compression = compression
+		db.AddBucket("docs_"+compression.String(), opts)
+		bucket := db.GetBucket("docs_" + compression.String())
+
+		err := bucket.Set(int64(1), doc)
+		if err != nil {
+			t.Fatalf("%v: can't set - err:%v", compression, err)
+		}
+		v, err := bucket.Get(int64(1))
+		if err != nil {
+			t.Fatalf("%v: can't get - err:%v", compression, err)
+		}
+		if v.(map[string]interface{})["description"] != doc["description"] {
+			t.Fatalf("%v: retrieved value differs: %v", compression, v)
+		}
+
+		stats, err := bucket.Stats()
+		if err != nil {
+			t.Fatalf("%v: can't get stats - err:%v", compression, err)
+		}
+		if stats.Count != 1 || stats.CompressedValues != 1 || stats.CompressionRatio <= 2 {
+			t.Fatalf("%v: unexpected stats %+v", compression, stats)
+		}
+	}
+
+	// compressed and uncompressed values coexist in the same bucket
+	bucket := db.GetBucket("docs_flate")
+	bucket.Opts.Compression = CompressionNone
+	err := bucket.Set(int64(2), doc)
+	if err != nil {
+		t.Fatalf("can't set - err:%v", err)
+	}
+	bucket.Opts.Compression = CompressionSnappy
+	for _, k := range []int64{1, 2} {
+		v, err := bucket.Get(k)
+		if err != nil || v.(map[string]interface{})["title"] != doc["title"] {
+			t.Fatalf("can't get back value %v after changing compression - v:%v err:%v", k, v, err)
+		}
+	}
+	stats, _ := bucket.Stats()
+	if stats.Count != 2 || stats.CompressedValues != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCompressionLegacyBucket(t *testing.T) {
+	forEachBackend(t, testCompressionLegacyBucket)
+}
+
+func testCompressionLegacyBucket(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	// values written before PureDB kept bucket records, without headers
+	err := db.update(func(txn StorageTxn) error {
+		for k := int64(1); k <= 3; k++ {
+			if err := txn.Set(append([]byte("counts__"), i64tob(k)...), i64tob(k*5)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(k int64) []byte {
+		var v_b []byte
+		err := db.view(func(txn StorageTxn) error {
+			v, err := txn.Get(append([]byte("counts__"), i64tob(k)...))
+			v_b = append([]byte(nil), v...)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v_b
+	}
+
+	// they are left as they are by Setup, and by the writes before Migrate
+	opts := BucketOptsIntInt
+	opts.Compression = CompressionSnappy
+	if err := db.AddBucket("counts", opts); err != nil {
+		t.Fatalf("can't open legacy bucket with compression - err:%v", err)
+	}
+	bucket := db.GetBucket("counts")
+	if err := bucket.Set(int64(4), int64(20)); err != nil {
+		t.Fatalf("can't set - err:%v", err)
+	}
+	for k := int64(1); k <= 4; k++ {
+		if v, err := bucket.Get(k); err != nil || v != k*5 {
+			t.Fatalf("legacy value %d is %v - err:%v", k, v, err)
+		}
+		if v_b := stored(k); len(v_b) != 8 {
+			t.Fatalf("legacy value %d rewritten before Migrate: %x", k, v_b)
+		}
+	}
+
+	// Migrate adds the headers
+	if migrated, err := bucket.Migrate(context.Background()); err != nil || migrated != 4 {
+		t.Fatalf("Migrate rewrote %d values - err:%v", migrated, err)
+	}
+	if migrated, err := bucket.Migrate(context.Background()); err != nil || migrated != 0 {
+		t.Fatalf("second Migrate rewrote %d values - err:%v", migrated, err)
+	}
+	bucket.Set(int64(5), int64(25))
+	for k := int64(1); k <= 5; k++ {
+		if v, err := bucket.Get(k); err != nil || v != k*5 {
+			t.Fatalf("migrated value %d is %v - err:%v", k, v, err)
+		}
+		if v_b := stored(k); len(v_b) != 9 || v_b[0] != byte(codecStored) {
+			t.Fatalf("value %d stored without a header after Migrate: %x", k, v_b)
+		}
+	}
+	db.AddBucket("counts", opts)
+	bucket = db.GetBucket("counts")
+	if !bucket.framedAll {
+		t.Fatal("migrated bucket not set up as framed")
+	}
+
+	// a headerless value slipped in afterwards is an error, not a panic
+	err = db.update(func(txn StorageTxn) error {
+		return txn.Set(append([]byte("counts__"), i64tob(9)...), i64tob(5))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := bucket.Get(int64(9)); err == nil {
+		t.Fatalf("read headerless value as %v", v)
+	}
+}
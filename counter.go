@@ -0,0 +1,236 @@
+package puredb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Incr adds delta to the integer value of the record with key k, created
+// with value delta if missing, and returns the new value. Values are read
+// and written with the codecs of the bucket, which must handle int64 like
+// BucketOptsIntInt. Increments conflicting with concurrent writes to the
+// record are retried.
+//
+// With CounterShards, the increments are spread over that many sub-keys,
+// so that concurrent increments of the same counter seldom conflict, and
+// the record itself is left untouched. The value returned is then only
+// approximate: it's summed in another transaction after the increment
+// commits, since reading the other shards in the same one would make
+// concurrent increments conflict again, so it may include increments
+// made since, or miss ones committed meanwhile. Use Get or Counter to
+// read the value of sharded counters.
+func (bucket *Bucket) Incr(k interface{}, delta int64) (int64, error) {
+	db := bucket.DB
+	start := time.Now()
+
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	k_b, err := bucket.MarshalKey(k)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int64
+	for {
+		err = db.update(func(txn StorageTxn) error {
+			if bucket.Opts.CounterShards > 1 {
+				return bucket.incrShard(txn, k_b, delta)
+			}
+			var err error
+			value, err = bucket.counterValue(txn, k_b)
+			if err != nil {
+				return err
+			}
+			value += delta
+			if err := bucket.reindex(txn, k_b, value, false); err != nil {
+				return err
+			}
+			if err := bucket.dropPending(txn, k_b); err != nil {
+				return err
+			}
+			v_b, err := bucket.encodeValue(txn, k_b, value)
+			if err != nil {
+				return err
+			}
+			if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
+				return err
+			}
+			return txn.Set(bucket.recordKey(k_b), v_b)
+		})
+		if err != ErrConflict {
+			break
+		}
+	}
+	if err == nil && bucket.Opts.CounterShards > 1 {
+		// approximate, see above
+		value, err = bucket.Counter(k)
+	}
+
+	bucket.logOp("incr", start, len(k_b), err)
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// Decr subtracts delta from the integer value of the record with key k,
+// like Incr.
+func (bucket *Bucket) Decr(k interface{}, delta int64) (int64, error) {
+	return bucket.Incr(k, -delta)
+}
+
+// Counter returns the integer value of the record with key k, summed with
+// its shards if CounterShards is set, or 0 if there is none.
+func (bucket *Bucket) Counter(k interface{}) (int64, error) {
+	k_b, err := bucket.MarshalKey(k)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int64
+	err = bucket.DB.view(func(txn StorageTxn) error {
+		var err error
+		value, err = bucket.counterValue(txn, k_b)
+		return err
+	})
+	return value, err
+}
+
+// getCounter reads the value of the record with key k_b of a bucket with
+// CounterShards, summed with its shards, or returns ErrKeyNotFound if
+// there is neither a record, nor shards, nor merge operands.
+func (bucket *Bucket) getCounter(txn StorageTxn, k_b []byte, found bool, v *interface{}) error {
+	if !found {
+		keys, _, err := bucket.counterShards(txn, k_b)
+		if err != nil {
+			return err
+		}
+		found = len(keys) > 0
+	}
+	if !found && bucket.Opts.MergeFn != nil {
+		keys, _, err := bucket.pendingMerges(txn, k_b)
+		if err != nil {
+			return err
+		}
+		found = len(keys) > 0
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	value, err := bucket.counterValue(txn, k_b)
+	if err != nil {
+		return err
+	}
+	*v = value
+	return nil
+}
+
+// counterValue returns the integer value of the record with key k_b, 0 if
+// missing, summed with its shards.
+func (bucket *Bucket) counterValue(txn StorageTxn, k_b []byte) (int64, error) {
+	var v interface{}
+	v_b, err := txn.Get(bucket.recordKey(k_b))
+	switch {
+	case bucket.Opts.MergeFn != nil && (err == nil || err == ErrKeyNotFound):
+		err = bucket.getMerged(txn, k_b, v_b, err == nil, &v)
+		if err == ErrKeyNotFound {
+			err = nil
+		}
+	case err == ErrKeyNotFound:
+		err = nil
+	case err == nil:
+		err = bucket.decodeValue(txn, k_b, v_b, &v)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	value := int64(0)
+	if v != nil {
+		if value, err = toInt64(v); err != nil {
+			return 0, err
+		}
+	}
+
+	if bucket.Opts.CounterShards > 1 {
+		_, shards, err := bucket.counterShards(txn, k_b)
+		if err != nil {
+			return 0, err
+		}
+		for _, shard := range shards {
+			value += shard
+		}
+	}
+	return value, nil
+}
+
+// shardPrefix starts the keys of the counter shards of the record with key
+// k_b, escaped like index values. Each is followed by the shard number,
+// and holds a big-endian int64.
+func (bucket *Bucket) shardPrefix(k_b []byte) []byte {
+	return appendIndexBytes([]byte(metaPrefix+"shard__"+bucket.Name+"__"), k_b)
+}
+
+// incrShard adds delta to a random shard of the counter with key k_b.
+func (bucket *Bucket) incrShard(txn StorageTxn, k_b []byte, delta int64) error {
+	shard := rand.Intn(bucket.Opts.CounterShards)
+	key := append(bucket.shardPrefix(k_b), u64tob(uint64(shard))...)
+
+	value := int64(0)
+	v_b, err := txn.Get(key)
+	switch {
+	case err == ErrKeyNotFound:
+	case err != nil:
+		return err
+	case len(v_b) != 8:
+		return fmt.Errorf("puredb: invalid counter shard in bucket %q", bucket.Name)
+	default:
+		value = int64(binary.BigEndian.Uint64(v_b))
+	}
+	return txn.Set(key, i64tob(value+delta))
+}
+
+// counterShards returns the keys and values of the counter shards of the
+// record with key k_b.
+func (bucket *Bucket) counterShards(txn StorageTxn, k_b []byte) ([][]byte, []int64, error) {
+	prefix := bucket.shardPrefix(k_b)
+
+	var keys [][]byte
+	var values []int64
+	it := txn.NewIterator(defaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		v_b, err := it.Value()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(v_b) != 8 {
+			return nil, nil, fmt.Errorf("puredb: invalid counter shard in bucket %q", bucket.Name)
+		}
+		keys = append(keys, append([]byte(nil), it.Key()...))
+		values = append(values, int64(binary.BigEndian.Uint64(v_b)))
+	}
+	return keys, values, nil
+}
+
+// dropShards deletes the counter shards of the record with key k_b.
+func (bucket *Bucket) dropShards(txn StorageTxn, k_b []byte) error {
+	if bucket.Opts.CounterShards <= 1 {
+		return nil
+	}
+	keys, _, err := bucket.counterShards(txn, k_b)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
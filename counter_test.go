@@ -0,0 +1,87 @@
+package puredb
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIncr(t *testing.T) {
+	forEachBackend(t, testIncr)
+}
+
+func testIncr(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	incrAll := func(bucket *Bucket) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := bucket.Incr("hits", 1); err != nil {
+						t.Errorf("can't increment - err:%v", err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	opts := BucketOptsIntInt
+	opts.MarshalKeyFn = func(v interface{}) ([]byte, error) {
+		return []byte(v.(string)), nil
+	}
+	opts.UnmarshalKeyFn = func(data []byte, v *interface{}) error {
+		*v = string(data)
+		return nil
+	}
+	db.AddBucket("counters", opts)
+	bucket := db.GetBucket("counters")
+	incrAll(bucket)
+	if v, err := bucket.Get("hits"); err != nil || v != int64(200) {
+		t.Fatalf("counter is %v - err:%v", v, err)
+	}
+	if v, err := bucket.Decr("hits", 50); err != nil || v != 150 {
+		t.Fatalf("decremented counter is %v - err:%v", v, err)
+	}
+	if v, err := bucket.Decr("misses", 1); err != nil || v != -1 {
+		t.Fatalf("new counter is %v - err:%v", v, err)
+	}
+
+	opts.CounterShards = 4
+	db.AddBucket("sharded", opts)
+	bucket = db.GetBucket("sharded")
+	incrAll(bucket)
+	if v, err := bucket.Counter("hits"); err != nil || v != 200 {
+		t.Fatalf("sharded counter is %v - err:%v", v, err)
+	}
+	if v, err := bucket.Get("hits"); err != nil || v != int64(200) {
+		t.Fatalf("sharded counter read with Get is %v - err:%v", v, err)
+	}
+	if _, err := bucket.Get("misses"); err != ErrKeyNotFound {
+		t.Fatalf("missing sharded counter - err:%v", err)
+	}
+	bucket.Set("hits", int64(5))
+	if v, err := bucket.Incr("hits", 2); err != nil || v != 7 {
+		t.Fatalf("sharded counter is %v after set - err:%v", v, err)
+	}
+	bucket.Delete("hits")
+	if v, err := bucket.Counter("hits"); err != nil || v != 0 {
+		t.Fatalf("deleted sharded counter is %v - err:%v", v, err)
+	}
+	if _, err := bucket.Get("hits"); err != ErrKeyNotFound {
+		t.Fatalf("deleted sharded counter - err:%v", err)
+	}
+
+	// Pop drops the shards of the record it removes
+	bucket.Set("aaa", int64(1))
+	bucket.Incr("aaa", 3)
+	if k, v, err := bucket.Pop(false); err != nil || k != "aaa" || v != int64(1) {
+		t.Fatalf("popped %v: %v - err:%v", k, v, err)
+	}
+	if v, err := bucket.Counter("aaa"); err != nil || v != 0 {
+		t.Fatalf("popped sharded counter is %v - err:%v", v, err)
+	}
+}
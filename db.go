@@ -3,14 +3,24 @@ package puredb
 import (
 	"github.com/dgraph-io/badger"
 	"os"
-	"log"
+	"sync"
 )
 
 type PureDB struct {
-	DB *badger.DB
 	badgerOpts badger.Options
 	Pathname string
 
+	storage Storage
+
+	logger        Logger
+	seqBandwidth  uint64
+	readOnly      bool
+	inMemory      bool
+	encryption    KeyProvider
+
+	cursorMu  sync.Mutex
+	cursorKey []byte
+
 	buckets buckets
 }
 
@@ -30,6 +40,8 @@ func Open(pathname string, options ...PureDBOptionFn) (*PureDB, error) {
 	pureDb := PureDB{
 		badgerOpts: opts,
 		Pathname: pathname,
+		logger: nopLogger{},
+		seqBandwidth: defaultSequenceBandwidth,
 	}
 	for _, option := range options {
 		err := option(&pureDb)
@@ -38,35 +50,43 @@ func Open(pathname string, options ...PureDBOptionFn) (*PureDB, error) {
 		}
 	}
 
-	badgerDb, err := badger.Open(pureDb.badgerOpts)
-	if err != nil {
-		log.Printf("can't open/create DB pathname: %q err: %v", pureDb.badgerOpts.Dir, err)
-		return nil, err
+	switch {
+	case pureDb.storage != nil:
+		pureDb.Pathname = ""
+	case pureDb.inMemory:
+		pureDb.Pathname = ""
+		pureDb.storage = newMemoryStorage()
+	default:
+		storage, err := NewBadgerStorage(pureDb.badgerOpts)
+		if err != nil {
+			pureDb.logger.Error("puredb: can't open/create DB", "pathname", pureDb.badgerOpts.Dir, "err", err)
+			return nil, err
+		}
+		pureDb.storage = storage
 	}
-	pureDb.DB = badgerDb
 
 	pureDb.buckets.Init(&pureDb)
 
+	pureDb.logger.Debug("puredb: open", "pathname", pathname)
+
 	return &pureDb, nil
 }
 
 func (db *PureDB) Close() {
 	db.buckets.Cleanup()
-	db.DB.Close()
+	db.storage.Close()
 }
 
 func (db *PureDB) Destroy() {
 	db.buckets.Cleanup()
-	db.DB.Close()
-	os.RemoveAll(db.Pathname)
-}
-
-func (db *PureDB) Badger() *badger.DB {
-	return db.DB
+	db.storage.Close()
+	if db.Pathname != "" {
+		os.RemoveAll(db.Pathname)
+	}
 }
 
 func (db *PureDB) AddBucket(name string, opts BucketOpts) error {
-	log.Printf("PureDB::AddBucket - name:%v opts:%v", name, opts)
+	db.logger.Debug("puredb: add bucket", "bucket", name)
 	return db.buckets.Add(name, opts)
 }
 
@@ -0,0 +1,228 @@
+package puredb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys used to encrypt the values of a bucket.
+//
+// Each encrypted value records the ID of the key used for it, so keys can
+// be rotated: new values use the current key, while older ones are
+// decrypted with the key they were written with until RotateKeys
+// re-encrypts them.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new values with, and its ID.
+	// IDs are at most 255 bytes long.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// DatabaseKey, set as the Encryption of a bucket, encrypts its values with
+// the database key set by WithEncryptionKey. Setting up the bucket fails if
+// the database has none.
+var DatabaseKey KeyProvider = databaseKey{}
+
+type databaseKey struct{}
+
+func (databaseKey) CurrentKey() (string, []byte, error) {
+	return "", nil, fmt.Errorf("puredb: the database has no encryption key")
+}
+
+func (databaseKey) Key(id string) ([]byte, error) {
+	return nil, fmt.Errorf("puredb: the database has no encryption key")
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+// NewKeyRing returns a KeyRing whose current key is key.
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string][]byte)}
+	if err := ring.Add(id, key); err != nil {
+		return nil, err
+	}
+	ring.current = id
+	return ring, nil
+}
+
+// Add adds a key to the ring, without making it the current one.
+func (ring *KeyRing) Add(id string, key []byte) error {
+	if err := checkEncryptionKey(id, key); err != nil {
+		return err
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// SetCurrent makes the key with the given ID the one used for new values.
+func (ring *KeyRing) SetCurrent(id string) error {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	if _, ok := ring.keys[id]; !ok {
+		return fmt.Errorf("puredb: unknown encryption key %q", id)
+	}
+	ring.current = id
+	return nil
+}
+
+func (ring *KeyRing) CurrentKey() (string, []byte, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	return ring.current, ring.keys[ring.current], nil
+}
+
+func (ring *KeyRing) Key(id string) ([]byte, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	key, ok := ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("puredb: unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+func checkEncryptionKey(id string, key []byte) error {
+	if len(id) > 255 {
+		return fmt.Errorf("puredb: encryption key ID %q is longer than 255 bytes", id)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("puredb: invalid length %d for encryption key %q, must be 16, 24 or 32 bytes", len(key), id)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPayload encrypts payload with the current key of the bucket,
+// returning the key ID length, key ID, nonce and ciphertext. The envelope
+// head and the record key are authenticated, so that a value can't be
+// moved to another record or have its header altered.
+func (bucket *Bucket) encryptPayload(head []byte, k_b []byte, payload []byte) ([]byte, error) {
+	id, key, err := bucket.Opts.Encryption.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEncryptionKey(id, key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+len(id)+aead.NonceSize(), 1+len(id)+aead.NonceSize()+len(payload)+aead.Overhead())
+	out[0] = byte(len(id))
+	copy(out[1:], id)
+	nonce := out[1+len(id):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, payload, encryptionAD(head, k_b)), nil
+}
+
+// decryptPayload reverses encryptPayload, returning the plaintext and the
+// ID of the key it was encrypted with.
+func (bucket *Bucket) decryptPayload(head []byte, k_b []byte, sealed []byte) ([]byte, string, error) {
+	if bucket.Opts.Encryption == nil {
+		return nil, "", fmt.Errorf("puredb: value is encrypted but bucket %q has no key provider", bucket.Name)
+	}
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, "", fmt.Errorf("puredb: truncated encrypted value")
+	}
+	id := string(sealed[1 : 1+int(sealed[0])])
+	sealed = sealed[1+len(id):]
+
+	key, err := bucket.Opts.Encryption.Key(id)
+	if err != nil {
+		return nil, id, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, id, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, id, fmt.Errorf("puredb: truncated encrypted value")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], encryptionAD(head, k_b))
+	if err != nil {
+		return nil, id, fmt.Errorf("puredb: can't decrypt value with key %q: %v", id, err)
+	}
+	return plain, id, nil
+}
+
+func encryptionAD(head []byte, k_b []byte) []byte {
+	ad := make([]byte, 0, len(head)+len(k_b))
+	ad = append(ad, head...)
+	return append(ad, k_b...)
+}
+
+// valueKeyID returns the ID of the key a stored value is encrypted with,
+// or "" if it isn't encrypted.
+func valueKeyID(stored []byte) string {
+	e, err := parseEnvelope(stored)
+	if err != nil || e.header()&envelopeEncrypted == 0 {
+		return ""
+	}
+	if len(e.payload) < 1 || len(e.payload) < 1+int(e.payload[0]) {
+		return ""
+	}
+	return string(e.payload[1 : 1+int(e.payload[0])])
+}
+
+// RotateKeys re-encrypts with the current key all the values of the
+// bucket written with another key, or not encrypted at all. It works
+// online, in transactions of at most batchSize values, and returns the
+// number of values re-encrypted. The values stored before there were
+// envelopes are left to Migrate.
+//
+// Batches conflicting with concurrent writes are retried.
+func (bucket *Bucket) RotateKeys(ctx context.Context, batchSize int) (int, error) {
+	if bucket.Opts.Encryption == nil {
+		return 0, fmt.Errorf("puredb: bucket %q has no key provider", bucket.Name)
+	}
+
+	id, _, err := bucket.Opts.Encryption.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	rotated, err := bucket.rewriteValues(ctx, nil, batchSize, func(txn StorageTxn, k_b []byte, v_b []byte) ([]byte, error) {
+		framed, err := bucket.framed(txn, k_b)
+		if err != nil || !framed || valueKeyID(v_b) == id {
+			return nil, err
+		}
+		data, version, err := bucket.openEnvelope(k_b, v_b)
+		if err != nil {
+			return nil, err
+		}
+		return bucket.sealValue(k_b, data, version)
+	}, nil)
+
+	bucket.DB.logger.Debug("puredb: rotate keys", "bucket", bucket.Name, "rotated", rotated, "err", err)
+	return rotated, err
+}
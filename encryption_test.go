@@ -0,0 +1,132 @@
+package puredb
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	forEachBackend(t, testEncryption)
+}
+
+func testEncryption(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	if _, err := NewKeyRing("k1", []byte("short")); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+	ring, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("can't create key ring - err:%v", err)
+	}
+
+	doc := map[string]interface{}{
+		"title":       "Much Ado About Nothing",
+		"description": strings.Repeat("a comedy by William Shakespeare, ", 20),
+	}
+
+	opts := BucketOptsIntJSON
+	opts.Compression = CompressionSnappy
+	opts.Encryption = ring
+	db.AddBucket("secrets", opts)
+	bucket := db.GetBucket("secrets")
+
+	for k := int64(1); k <= 10; k++ {
+		if err := bucket.Set(k, doc); err != nil {
+			t.Fatalf("can't set - err:%v", err)
+		}
+	}
+
+	// values are not stored in clear, and are bound to their key
+	var stored []byte
+	db.view(func(txn StorageTxn) error {
+		v, err := txn.Get(append([]byte("secrets__"), i64tob(1)...))
+		stored = append([]byte(nil), v...)
+		return err
+	})
+	if bytes.Contains(stored, []byte("Shakespeare")) || valueKeyID(stored) != "k1" {
+		t.Fatalf("value is not encrypted with k1: %q", stored)
+	}
+	if _, _, err := bucket.openEnvelope(i64tob(2), stored); err == nil {
+		t.Fatal("expected an error opening a value under another key")
+	}
+
+	// rotate to a new key: old values stay readable, then get re-encrypted
+	ring.Add("k2", bytes.Repeat([]byte{2}, 16))
+	ring.SetCurrent("k2")
+	if err := bucket.Set(int64(11), doc); err != nil {
+		t.Fatalf("can't set - err:%v", err)
+	}
+	v, err := bucket.Get(int64(1))
+	if err != nil || v.(map[string]interface{})["title"] != doc["title"] {
+		t.Fatalf("can't get value encrypted with the old key - v:%v err:%v", v, err)
+	}
+
+	rotated, err := bucket.RotateKeys(context.Background(), 3)
+	if err != nil || rotated != 10 {
+		t.Fatalf("RotateKeys returned %v, expected 10 (err:%v)", rotated, err)
+	}
+	if rotated, _ := bucket.RotateKeys(context.Background(), 3); rotated != 0 {
+		t.Fatalf("second RotateKeys re-encrypted %v values", rotated)
+	}
+
+	delete(ring.keys, "k1")
+	for k := int64(1); k <= 11; k++ {
+		v, err := bucket.Get(k)
+		if err != nil || v.(map[string]interface{})["title"] != doc["title"] {
+			t.Fatalf("can't get value %v after rotation - v:%v err:%v", k, v, err)
+		}
+	}
+}
+
+func TestEncryptionKeyOption(t *testing.T) {
+	forEachBackend(t, testEncryptionKeyOption)
+}
+
+func testEncryptionKeyOption(t *testing.T, options ...PureDBOptionFn) {
+	key := bytes.Repeat([]byte{3}, 32)
+	db := OpenTestDB(t, append(options, WithEncryptionKey(key))...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntJSON
+	opts.Encryption = DatabaseKey
+	if err := db.AddBucket("secrets", opts); err != nil {
+		t.Fatalf("can't add bucket - err:%v", err)
+	}
+	db.AddBucket("plain", BucketOptsIntJSON)
+	doc := map[string]interface{}{"title": "Much Ado About Nothing"}
+	stored := func(name string) []byte {
+		bucket := db.GetBucket(name)
+		if err := bucket.Set(int64(1), doc); err != nil {
+			t.Fatalf("can't set - err:%v", err)
+		}
+		if v, err := bucket.Get(int64(1)); err != nil || v.(map[string]interface{})["title"] != doc["title"] {
+			t.Fatalf("can't get back value - v:%v err:%v", v, err)
+		}
+		var stored []byte
+		db.view(func(txn StorageTxn) error {
+			v, err := txn.Get(append([]byte(name+"__"), i64tob(1)...))
+			stored = append([]byte(nil), v...)
+			return err
+		})
+		return stored
+	}
+
+	if v := stored("secrets"); bytes.Contains(v, []byte("Much Ado")) || valueKeyID(v) != DefaultEncryptionKeyID {
+		t.Fatalf("value is not encrypted with the database key: %q", v)
+	}
+	// buckets that don't opt in are left alone
+	if v := stored("plain"); !bytes.Contains(v, []byte("Much Ado")) {
+		t.Fatalf("value of a bucket without encryption is encrypted: %q", v)
+	}
+
+	// opting in without a database key fails instead of storing in clear
+	nokey := OpenTestDB(t, options...)
+	defer nokey.Destroy()
+	if err := nokey.AddBucket("secrets", opts); err == nil {
+		t.Fatalf("expected an error using DatabaseKey without a database key")
+	}
+}
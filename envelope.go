@@ -0,0 +1,209 @@
+package puredb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Values are stored in an envelope: a header byte followed by the payload.
+// The header is what lets values written with different settings
+// (compressed or not, encrypted or not, versioned or not) coexist in the
+// same bucket, so that changing them needs no conversion.
+//
+// The values of buckets set up before there were envelopes are stored as
+// produced by MarshalValueFn. They are kept that way, and so are the
+// values written to them, until Migrate wraps them in envelopes, in key
+// order: the frame boundary of the bucket is the key before which its
+// values are in envelopes.
+//
+// Header layout:
+//
+//	bits 0-2  compression codec of the payload (codecStored if none)
+//	bit  3    the payload is encrypted, see encryptPayload
+//	bit  4    the header byte is followed by the uvarint schema version
+//	bits 5-7  reserved, must be zero
+const (
+	envelopeCodecMask = 0x07
+	envelopeEncrypted = 0x08
+	envelopeVersioned = 0x10
+	envelopeKnownBits = envelopeCodecMask | envelopeEncrypted | envelopeVersioned
+)
+
+// envelope is a parsed stored value.
+type envelope struct {
+	// head is the header byte and the schema version, authenticated along
+	// with the payload when it's encrypted.
+	head    []byte
+	version uint32
+	payload []byte
+}
+
+func (e envelope) header() byte {
+	return e.head[0]
+}
+
+// frameKey is the key of the frame boundary of a bucket whose values
+// weren't all in envelopes when it was set up. It holds a prefixed record
+// key, or is missing if Migrate never ran.
+func (bucket *Bucket) frameKey() []byte {
+	return []byte(metaPrefix + "frame__" + bucket.Name)
+}
+
+// framed reports whether the record with key k_b is stored in an envelope
+// in the snapshot of txn. Reading the frame boundary in txn makes the
+// writes conflict with the batches of Migrate moving it.
+func (bucket *Bucket) framed(txn StorageTxn, k_b []byte) (bool, error) {
+	if bucket.framedAll {
+		return true, nil
+	}
+	boundary, err := txn.Get(bucket.frameKey())
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Compare(bucket.recordKey(k_b), boundary) < 0, nil
+}
+
+// encodeValue marshals v and wraps it in an envelope, unless the bucket
+// still holds values without one at key k_b, returning the bytes to store
+// there.
+func (bucket *Bucket) encodeValue(txn StorageTxn, k_b []byte, v interface{}) ([]byte, error) {
+	framed, err := bucket.framed(txn, k_b)
+	if err != nil {
+		return nil, err
+	}
+	if !framed {
+		return bucket.MarshalValue(v)
+	}
+	return bucket.encodeFramed(k_b, v)
+}
+
+// decodeValue unwraps the value stored at key k_b, upgrades it to the
+// current schema version and unmarshals it into v.
+func (bucket *Bucket) decodeValue(txn StorageTxn, k_b []byte, stored []byte, v *interface{}) error {
+	data, version, err := bucket.openValue(txn, k_b, stored)
+	if err != nil {
+		return err
+	}
+	data, err = bucket.upgradeValue(data, version)
+	if err != nil {
+		return err
+	}
+	return bucket.UnmarshalValue(data, v)
+}
+
+// encodeFramed is like encodeValue, for values always stored in
+// envelopes, bound to key k_b.
+func (bucket *Bucket) encodeFramed(k_b []byte, v interface{}) ([]byte, error) {
+	data, err := bucket.MarshalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.sealValue(k_b, data, bucket.Opts.SchemaVersion)
+}
+
+// decodeFramed reverses encodeFramed.
+func (bucket *Bucket) decodeFramed(k_b []byte, stored []byte, v *interface{}) error {
+	data, version, err := bucket.openEnvelope(k_b, stored)
+	if err != nil {
+		return err
+	}
+	data, err = bucket.upgradeValue(data, version)
+	if err != nil {
+		return err
+	}
+	return bucket.UnmarshalValue(data, v)
+}
+
+// sealValue wraps marshaled data, of the given schema version, in an
+// envelope.
+func (bucket *Bucket) sealValue(k_b []byte, data []byte, version uint32) ([]byte, error) {
+	codec := codecStored
+	if bucket.Opts.Compression != CompressionNone {
+		var err error
+		codec, err = bucket.Opts.Compression.codec()
+		if err != nil {
+			return nil, err
+		}
+	}
+	payload, codec, err := compress(codec, data)
+	if err != nil {
+		return nil, err
+	}
+
+	head := []byte{byte(codec)}
+	if bucket.Opts.Encryption != nil {
+		head[0] |= envelopeEncrypted
+	}
+	if bucket.Opts.SchemaVersion > 0 {
+		head[0] |= envelopeVersioned
+		var buf [binary.MaxVarintLen32]byte
+		head = append(head, buf[:binary.PutUvarint(buf[:], uint64(version))]...)
+	}
+	if bucket.Opts.Encryption != nil {
+		payload, err = bucket.encryptPayload(head, k_b, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, len(head)+len(payload))
+	copy(out, head)
+	copy(out[len(head):], payload)
+	return out, nil
+}
+
+// openValue returns the marshaled data wrapped in the value stored at k_b,
+// and its schema version. Values without an envelope are version 1.
+func (bucket *Bucket) openValue(txn StorageTxn, k_b []byte, stored []byte) ([]byte, uint32, error) {
+	framed, err := bucket.framed(txn, k_b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !framed {
+		return stored, 1, nil
+	}
+	return bucket.openEnvelope(k_b, stored)
+}
+
+func (bucket *Bucket) openEnvelope(k_b []byte, stored []byte) ([]byte, uint32, error) {
+	e, err := parseEnvelope(stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload := e.payload
+	if e.header()&envelopeEncrypted != 0 {
+		payload, _, err = bucket.decryptPayload(e.head, k_b, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	data, err := decompress(compressionCodec(e.header()&envelopeCodecMask), payload)
+	return data, e.version, err
+}
+
+func parseEnvelope(stored []byte) (envelope, error) {
+	if len(stored) == 0 {
+		return envelope{}, fmt.Errorf("puredb: missing value header")
+	}
+	header := stored[0]
+	if header&^envelopeKnownBits != 0 {
+		return envelope{}, fmt.Errorf("puredb: unknown value header 0x%02x", header)
+	}
+
+	// values stored before the bucket was versioned are version 1
+	e := envelope{head: stored[:1], version: 1}
+	if header&envelopeVersioned != 0 {
+		version, n := binary.Uvarint(stored[1:])
+		if n <= 0 || version > 1<<32-1 {
+			return envelope{}, fmt.Errorf("puredb: invalid value schema version")
+		}
+		e.head = stored[:1+n]
+		e.version = uint32(version)
+	}
+	e.payload = stored[len(e.head):]
+	return e, nil
+}
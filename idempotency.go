@@ -0,0 +1,155 @@
+package puredb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// defaultIdempotencyTTL is how long idempotency keys are remembered by
+// default.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// AddIdempotent is like Add, but only adds v the first time it's called
+// with idemKey: later calls return the key v was added with, even if the
+// record has been deleted since. The idempotency key is remembered in the
+// same transaction that adds the record, for the IdempotencyTTL of the
+// bucket.
+//
+// Concurrent calls with the same idempotency key conflict: all of them but
+// one fail with ErrConflict, and return the key of the record added when
+// retried.
+func (bucket *Bucket) AddIdempotent(idemKey string, v interface{}) (int64, error) {
+	if idemKey == "" {
+		return 0, fmt.Errorf("puredb: empty idempotency key")
+	}
+	var id int64
+	_, err := bucket.insert("add idempotent", v, idemKey, func(k interface{}) error {
+		var err error
+		id, err = intID(k)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// InsertIdempotent is like AddIdempotent, for buckets whose IDGenerator
+// doesn't generate integers.
+func (bucket *Bucket) InsertIdempotent(idemKey string, v interface{}) (interface{}, error) {
+	if idemKey == "" {
+		return nil, fmt.Errorf("puredb: empty idempotency key")
+	}
+	return bucket.insert("insert idempotent", v, idemKey, nil)
+}
+
+// idempotencyPrefix starts the keys the idempotency keys of the bucket are
+// remembered at. Their values are the time they expire, in nanoseconds
+// since the epoch, followed by the key of the record.
+func (bucket *Bucket) idempotencyPrefix() []byte {
+	return []byte(metaPrefix + "idem__" + bucket.Name + "__")
+}
+
+func (bucket *Bucket) idempotencyTTL() time.Duration {
+	if bucket.Opts.IdempotencyTTL > 0 {
+		return bucket.Opts.IdempotencyTTL
+	}
+	return defaultIdempotencyTTL
+}
+
+// getIdempotent returns the key of the record added with idemKey, if it
+// hasn't expired.
+func (bucket *Bucket) getIdempotent(txn StorageTxn, idemKey string) ([]byte, bool, error) {
+	v_b, err := txn.Get(append(bucket.idempotencyPrefix(), idemKey...))
+	if err == ErrKeyNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(v_b) < 8 {
+		return nil, false, fmt.Errorf("puredb: invalid idempotency record in bucket %q", bucket.Name)
+	}
+	if int64(binary.BigEndian.Uint64(v_b)) <= time.Now().UnixNano() {
+		return nil, false, nil
+	}
+	return append([]byte(nil), v_b[8:]...), true, nil
+}
+
+func (bucket *Bucket) setIdempotent(txn StorageTxn, idemKey string, k_b []byte) error {
+	expires := time.Now().Add(bucket.idempotencyTTL()).UnixNano()
+	v_b := append(i64tob(expires), k_b...)
+	return txn.Set(append(bucket.idempotencyPrefix(), idemKey...), v_b)
+}
+
+// PurgeIdempotencyKeys deletes the expired idempotency keys of the bucket,
+// which are otherwise only ignored, and returns how many were deleted. It
+// works in transactions of at most batchSize deletions.
+func (bucket *Bucket) PurgeIdempotencyKeys(ctx context.Context, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("puredb: invalid batch size %d", batchSize)
+	}
+
+	db := bucket.DB
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	prefix := bucket.idempotencyPrefix()
+	start := prefix
+	purged := 0
+	for start != nil {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+
+		count := 0
+		var next []byte
+		err := db.update(func(txn StorageTxn) error {
+			count = 0
+			next = nil
+			now := time.Now().UnixNano()
+
+			// collect the batch first: the iterator must be closed
+			// before writing
+			var expired [][]byte
+			it := txn.NewIterator(defaultIteratorOptions)
+			for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+				if len(expired) == batchSize {
+					next = append([]byte(nil), it.Key()...)
+					break
+				}
+				v_b, err := it.Value()
+				if err != nil {
+					it.Close()
+					return err
+				}
+				if len(v_b) < 8 || int64(binary.BigEndian.Uint64(v_b)) <= now {
+					expired = append(expired, append([]byte(nil), it.Key()...))
+				}
+			}
+			it.Close()
+
+			for _, key := range expired {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			count = len(expired)
+			return nil
+		})
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged += count
+		start = next
+	}
+
+	db.logger.Debug("puredb: purge idempotency keys", "bucket", bucket.Name, "purged", purged)
+	return purged, nil
+}
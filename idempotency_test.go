@@ -0,0 +1,81 @@
+package puredb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAddIdempotent(t *testing.T) {
+	forEachBackend(t, testAddIdempotent)
+}
+
+func testAddIdempotent(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("numbers", BucketOptsIntInt)
+	bucket := db.GetBucket("numbers")
+
+	first, err := bucket.AddIdempotent("message-1", int64(10))
+	if err != nil {
+		t.Fatalf("can't add - err:%v", err)
+	}
+	second, err := bucket.AddIdempotent("message-2", int64(20))
+	if err != nil || second == first {
+		t.Fatalf("added %d after %d - err:%v", second, first, err)
+	}
+	for i := 0; i < 3; i++ {
+		if id, err := bucket.AddIdempotent("message-1", int64(30)); err != nil || id != first {
+			t.Fatalf("repeated add returned %d, not %d - err:%v", id, first, err)
+		}
+	}
+	// even if the record is gone
+	bucket.Delete(first)
+	if id, err := bucket.AddIdempotent("message-1", int64(30)); err != nil || id != first {
+		t.Fatalf("repeated add returned %d, not %d - err:%v", id, first, err)
+	}
+	if n, _ := bucket.Count(); n != 1 {
+		t.Fatalf("%d records", n)
+	}
+	if _, err := bucket.AddIdempotent("", int64(0)); err == nil {
+		t.Fatalf("added with an empty idempotency key")
+	}
+
+	opts := NewBucketOptsULID()
+	opts.MarshalValueFn = BucketOptsIntInt.MarshalValueFn
+	opts.UnmarshalValueFn = BucketOptsIntInt.UnmarshalValueFn
+	opts.IdempotencyTTL = 20 * time.Millisecond
+	db.AddBucket("events", opts)
+	bucket = db.GetBucket("events")
+	ulid, err := bucket.InsertIdempotent("event-1", int64(1))
+	if err != nil {
+		t.Fatalf("can't insert - err:%v", err)
+	}
+	if id, err := bucket.InsertIdempotent("event-1", int64(1)); err != nil || id != ulid {
+		t.Fatalf("repeated insert returned %v, not %v - err:%v", id, ulid, err)
+	}
+	if _, err := bucket.AddIdempotent("event-1", int64(1)); err == nil {
+		t.Fatalf("add returned a ULID")
+	}
+	bucket.InsertIdempotent("event-2", int64(2))
+
+	// expired idempotency keys are forgotten
+	time.Sleep(30 * time.Millisecond)
+	bucket.InsertIdempotent("event-3", int64(3))
+	if id, err := bucket.InsertIdempotent("event-1", int64(1)); err != nil || id == ulid {
+		t.Fatalf("insert after expiry returned %v - err:%v", id, err)
+	}
+	if n, _ := bucket.Count(); n != 4 {
+		t.Fatalf("%d records", n)
+	}
+	if purged, err := bucket.PurgeIdempotencyKeys(context.Background(), 1); err != nil || purged != 1 {
+		t.Fatalf("purged %d idempotency keys - err:%v", purged, err)
+	}
+	if id, err := bucket.InsertIdempotent("event-3", int64(3)); err != nil || id == nil {
+		t.Fatalf("repeated insert returned %v - err:%v", id, err)
+	}
+	if n, _ := bucket.Count(); n != 4 {
+		t.Fatalf("%d records after purge", n)
+	}
+}
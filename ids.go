@@ -0,0 +1,443 @@
+package puredb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// IDGenerator assigns the keys of the records added with Add and Insert.
+// The keys are marshaled with the MarshalKeyFn of the bucket, and should
+// sort in the order they were generated.
+type IDGenerator interface {
+	// NextID returns the key of a new record of bucket. It's called in the
+	// read-write transaction adding the record, which it can use to keep
+	// its state.
+	NextID(bucket *Bucket, txn StorageTxn) (interface{}, error)
+}
+
+// SequenceGenerator assigns int64 keys from a sequence starting at 0. It's
+// what buckets without an IDGenerator use.
+//
+// By default the numbers are leased from the storage in blocks (see
+// WithSequenceBandwidth), so that Adds don't conflict, and the numbers
+// leased but not used are lost when the database is closed. With GapFree,
+// the next number is stored along with each record instead, so there are
+// no gaps, but concurrent Adds conflict and fail with ErrConflict.
+type SequenceGenerator struct {
+	GapFree bool
+}
+
+func (g SequenceGenerator) NextID(bucket *Bucket, txn StorageTxn) (interface{}, error) {
+	if !g.GapFree {
+		if bucket.Seq == nil {
+			return nil, ErrReadOnly
+		}
+		num, err := bucket.Seq.Next()
+		return int64(num), err
+	}
+
+	key := []byte(metaPrefix + "seq__" + bucket.Name)
+	num := uint64(0)
+	v_b, err := txn.Get(key)
+	switch {
+	case err == ErrKeyNotFound:
+	case err != nil:
+		return nil, err
+	case len(v_b) != 8:
+		return nil, fmt.Errorf("puredb: invalid sequence of bucket %q", bucket.Name)
+	default:
+		num = binary.BigEndian.Uint64(v_b)
+	}
+	if err := txn.Set(key, u64tob(num+1)); err != nil {
+		return nil, err
+	}
+	return int64(num), nil
+}
+
+// ULID is a Universally Unique Lexicographically Sortable Identifier: a
+// 48-bit millisecond timestamp followed by 80 random bits.
+type ULID [16]byte
+
+// crockford is the alphabet of the Crockford base32 encoding of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// String returns the canonical 26 characters encoding of the ULID.
+func (id ULID) String() string {
+	s := make([]byte, 26)
+	// 130 bits, with two leading zero bits
+	for i := 25; i >= 0; i-- {
+		bit := (25 - i) * 5
+		var v uint16
+		for j := 0; j < 5; j++ {
+			n := bit + j
+			if n < 128 && id[15-n/8]&(1<<(uint(n)%8)) != 0 {
+				v |= 1 << uint(j)
+			}
+		}
+		s[i] = crockford[v]
+	}
+	return string(s)
+}
+
+// Time returns the time the ULID was generated, to the millisecond.
+func (id ULID) Time() time.Time {
+	return millisTime(id[:6])
+}
+
+// UUID is a RFC 9562 UUID. The ones assigned by UUIDv7Generator start with
+// a 48-bit millisecond timestamp.
+type UUID [16]byte
+
+// String returns the canonical 36 characters encoding of the UUID.
+func (id UUID) String() string {
+	s := hex.EncodeToString(id[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// Time returns the time a version 7 UUID was generated, to the
+// millisecond.
+func (id UUID) Time() time.Time {
+	return millisTime(id[:6])
+}
+
+func millisTime(b []byte) time.Time {
+	ms := int64(0)
+	for _, c := range b {
+		ms = ms<<8 | int64(c)
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+}
+
+// millisClock hands out millisecond timestamps that never go back, even if
+// the wall clock does.
+type millisClock struct {
+	last uint64
+}
+
+// next returns the current timestamp, and whether it's the same as the
+// previous one.
+func (c *millisClock) next() (uint64, bool) {
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= c.last {
+		return c.last, true
+	}
+	c.last = ms
+	return ms, false
+}
+
+// ULIDGenerator assigns ULID keys. ULIDs generated in the same
+// millisecond by a generator are made monotonic by incrementing the random
+// bits of the previous one.
+type ULIDGenerator struct {
+	mu    sync.Mutex
+	clock millisClock
+	last  ULID
+}
+
+// NewULIDGenerator returns a new ULID generator.
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{}
+}
+
+func (g *ULIDGenerator) NextID(bucket *Bucket, txn StorageTxn) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms, same := g.clock.next()
+	id := g.last
+	if same {
+		// increment the 80 random bits
+		i := 15
+		for ; i >= 6; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+		if i < 6 {
+			return nil, fmt.Errorf("puredb: too many ULIDs generated in the same millisecond")
+		}
+	} else {
+		putMillis(id[:6], ms)
+		if _, err := io.ReadFull(rand.Reader, id[6:]); err != nil {
+			return nil, err
+		}
+	}
+	g.last = id
+	return id, nil
+}
+
+// UUIDv7Generator assigns version 7 UUID keys. The 12 bits after the
+// timestamp count the UUIDs generated in the same millisecond, from a
+// random start, and the timestamp is moved ahead when they overflow.
+type UUIDv7Generator struct {
+	mu      sync.Mutex
+	clock   millisClock
+	counter uint16
+}
+
+// NewUUIDv7Generator returns a new version 7 UUID generator.
+func NewUUIDv7Generator() *UUIDv7Generator {
+	return &UUIDv7Generator{}
+}
+
+func (g *UUIDv7Generator) NextID(bucket *Bucket, txn StorageTxn) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var id UUID
+	if _, err := io.ReadFull(rand.Reader, id[6:]); err != nil {
+		return nil, err
+	}
+
+	ms, same := g.clock.next()
+	if same && g.counter < 0xFFF {
+		g.counter++
+	} else {
+		if same {
+			ms++
+			g.clock.last = ms
+		}
+		// leave room for the following ones
+		g.counter = uint16(id[6]&0x07)<<8 | uint16(id[7])
+	}
+
+	putMillis(id[:6], ms)
+	id[6] = 0x70 | byte(g.counter>>8)
+	id[7] = byte(g.counter)
+	id[8] = 0x80 | id[8]&0x3F
+	return id, nil
+}
+
+// snowflakeEpoch is the time Snowflake timestamps count from.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SnowflakeGenerator assigns int64 keys made of a 41-bit millisecond
+// timestamp since 2020, a 10-bit node number and a 12-bit counter of the
+// keys generated in the same millisecond. Processes adding to the same
+// buckets must use different node numbers.
+type SnowflakeGenerator struct {
+	node    int64
+	mu      sync.Mutex
+	clock   millisClock
+	counter int64
+}
+
+// NewSnowflakeGenerator returns a new Snowflake generator for node, from 0
+// to 1023.
+func NewSnowflakeGenerator(node int) (*SnowflakeGenerator, error) {
+	if node < 0 || node > 1023 {
+		return nil, fmt.Errorf("puredb: invalid snowflake node %d", node)
+	}
+	return &SnowflakeGenerator{node: int64(node)}, nil
+}
+
+func (g *SnowflakeGenerator) NextID(bucket *Bucket, txn StorageTxn) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms, same := g.clock.next()
+	if same && g.counter < 0xFFF {
+		g.counter++
+	} else {
+		if same {
+			ms++
+			g.clock.last = ms
+		}
+		g.counter = 0
+	}
+
+	elapsed := int64(ms) - snowflakeEpoch.UnixNano()/int64(time.Millisecond)
+	if elapsed < 0 || elapsed >= 1<<41 {
+		return nil, fmt.Errorf("puredb: clock out of the snowflake range")
+	}
+	return elapsed<<22 | g.node<<12 | g.counter, nil
+}
+
+func putMillis(b []byte, ms uint64) {
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// marshalID16 marshals ULID and UUID keys.
+func marshalID16(v interface{}) ([]byte, error) {
+	switch id := v.(type) {
+	case ULID:
+		return id[:], nil
+	case UUID:
+		return id[:], nil
+	}
+	return nil, fmt.Errorf("puredb: not a valid 16 bytes id: %v", v)
+}
+
+// NewBucketOptsULID returns options with ULID keys, assigned by Insert
+// from a generator of their own. The value codecs must be set before use.
+func NewBucketOptsULID() BucketOpts {
+	return BucketOpts{
+		MarshalKeyFn: marshalID16,
+		UnmarshalKeyFn: func(data []byte, v *interface{}) error {
+			var id ULID
+			if len(data) != len(id) {
+				return fmt.Errorf("puredb: invalid ULID length %d", len(data))
+			}
+			copy(id[:], data)
+			*v = id
+			return nil
+		},
+		IDGenerator: NewULIDGenerator(),
+	}
+}
+
+// NewBucketOptsUUIDv7 returns options with version 7 UUID keys, assigned
+// by Insert from a generator of their own. The value codecs must be set
+// before use.
+func NewBucketOptsUUIDv7() BucketOpts {
+	return BucketOpts{
+		MarshalKeyFn: marshalID16,
+		UnmarshalKeyFn: func(data []byte, v *interface{}) error {
+			var id UUID
+			if len(data) != len(id) {
+				return fmt.Errorf("puredb: invalid UUID length %d", len(data))
+			}
+			copy(id[:], data)
+			*v = id
+			return nil
+		},
+		IDGenerator: NewUUIDv7Generator(),
+	}
+}
+
+// Insert adds v to the bucket with a key assigned by its IDGenerator, and
+// returns the key.
+func (bucket *Bucket) Insert(v interface{}) (interface{}, error) {
+	return bucket.insert("insert", v, "", nil)
+}
+
+// insert adds v with a new key, checked by checkKey before writing. With
+// an idempotency key, a record is only added the first time, and the key
+// it was added with is returned afterwards.
+func (bucket *Bucket) insert(op string, v interface{}, idemKey string, checkKey func(k interface{}) error) (interface{}, error) {
+	db := bucket.DB
+	start := time.Now()
+	keySize := 0
+
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	generator := bucket.Opts.IDGenerator
+	if generator == nil {
+		generator = SequenceGenerator{}
+	}
+
+	var k interface{}
+	evicted := 0
+	err := db.update(func(txn StorageTxn) error {
+		if idemKey != "" {
+			k_b, found, err := bucket.getIdempotent(txn, idemKey)
+			if err != nil || found {
+				if err == nil {
+					op = op + " (repeated)"
+					keySize = len(k_b)
+					k, err = bucket.unmarshalID(k_b)
+				}
+				if err == nil && checkKey != nil {
+					err = checkKey(k)
+				}
+				return err
+			}
+		}
+
+		var err error
+		k, err = generator.NextID(bucket, txn)
+		if err != nil {
+			return err
+		}
+		if checkKey != nil {
+			if err := checkKey(k); err != nil {
+				return err
+			}
+		}
+		var k_b []byte
+		if bucket.Opts.IDGenerator == nil {
+			// like the keys assigned before there were generators
+			k_b = u64tob(uint64(k.(int64)))
+		} else {
+			k_b, err = bucket.MarshalKey(k)
+			if err != nil {
+				return err
+			}
+		}
+		keySize = len(k_b)
+
+		if bucket.Opts.PreAddFn != nil {
+			err := bucket.Opts.PreAddFn(bucket, k, v)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := bucket.reindex(txn, k_b, v, false); err != nil {
+			return err
+		}
+		v_b, err := bucket.encodeValue(txn, k_b, v)
+		if err != nil {
+			return err
+		}
+		if idemKey != "" {
+			if err := bucket.setIdempotent(txn, idemKey, k_b); err != nil {
+				return err
+			}
+		}
+		if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
+			return err
+		}
+		if err := txn.Set(bucket.recordKey(k_b), v_b); err != nil {
+			return err
+		}
+		evicted, err = bucket.evict(txn, k_b)
+		return err
+	})
+
+	bucket.logOp(op, start, keySize, err)
+	if evicted > 0 && err == nil {
+		db.logger.Debug("puredb: evict", "bucket", bucket.Name, "records", evicted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// unmarshalID unmarshals a key assigned by insert.
+func (bucket *Bucket) unmarshalID(k_b []byte) (interface{}, error) {
+	if bucket.Opts.IDGenerator == nil {
+		if len(k_b) != 8 {
+			return nil, fmt.Errorf("puredb: invalid sequence key length %d", len(k_b))
+		}
+		return int64(binary.BigEndian.Uint64(k_b)), nil
+	}
+	var k interface{}
+	err := bucket.UnmarshalKey(k_b, &k)
+	return k, err
+}
+
+// intID returns k as an int64, if it's an integer.
+func intID(k interface{}) (int64, error) {
+	rv := reflect.ValueOf(k)
+	switch {
+	case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+		return rv.Int(), nil
+	case isIntKind(rv.Kind()):
+		return int64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("puredb: generated key %v is a %T, use Insert", k, k)
+}
@@ -0,0 +1,135 @@
+package puredb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIDGenerators(t *testing.T) {
+	forEachBackend(t, testIDGenerators)
+}
+
+func testIDGenerators(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntInt
+	opts.IDGenerator = SequenceGenerator{GapFree: true}
+	db.AddBucket("gapfree", opts)
+	bucket := db.GetBucket("gapfree")
+	for i := int64(0); i < 3; i++ {
+		if id, err := bucket.Add(i); err != nil || id != i {
+			t.Fatalf("added %d - err:%v", id, err)
+		}
+	}
+
+	// the keys are passed to PreAddFn, in the order they sort in
+	var added []interface{}
+	opts = NewBucketOptsULID()
+	opts.MarshalValueFn = BucketOptsIntInt.MarshalValueFn
+	opts.UnmarshalValueFn = BucketOptsIntInt.UnmarshalValueFn
+	opts.PreAddFn = func(bucket *Bucket, k interface{}, v interface{}) error {
+		added = append(added, k)
+		return nil
+	}
+	db.AddBucket("ulids", opts)
+	bucket = db.GetBucket("ulids")
+	before := time.Now().Add(-time.Millisecond)
+	for i := int64(0); i < 100; i++ {
+		id, err := bucket.Insert(i)
+		if err != nil {
+			t.Fatalf("can't insert - err:%v", err)
+		}
+		if id != added[i] {
+			t.Fatalf("inserted %v, passed %v to PreAddFn", id, added[i])
+		}
+	}
+	if added[0].(ULID).Time().Before(before) {
+		t.Fatalf("ULID time %v before %v", added[0].(ULID).Time(), before)
+	}
+	if _, err := bucket.Add(int64(0)); err == nil || len(added) != 100 {
+		t.Fatalf("added a record with a ULID key")
+	}
+	if n, _ := bucket.Count(); n != 100 {
+		t.Fatalf("%d records with ULID keys", n)
+	}
+	checkOrder := func(bucket *Bucket, ids []interface{}) {
+		i := 0
+		err := bucket.IterateKeys(func(bucket *Bucket, k interface{}) error {
+			if k != ids[i] {
+				return fmt.Errorf("key %d is %v, not %v", i, k, ids[i])
+			}
+			i++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOrder(bucket, added)
+	if NewBucketOptsULID().IDGenerator == opts.IDGenerator {
+		t.Fatalf("ULID options share their generator")
+	}
+
+	added = nil
+	opts = NewBucketOptsUUIDv7()
+	opts.MarshalValueFn = BucketOptsIntInt.MarshalValueFn
+	opts.UnmarshalValueFn = BucketOptsIntInt.UnmarshalValueFn
+	db.AddBucket("uuids", opts)
+	bucket = db.GetBucket("uuids")
+	for i := int64(0); i < 5000; i++ {
+		id, err := bucket.Insert(i)
+		if err != nil {
+			t.Fatalf("can't insert - err:%v", err)
+		}
+		added = append(added, id)
+	}
+	s := added[0].(UUID).String()
+	if len(s) != 36 || s[14] != '7' || strings.IndexByte("89ab", s[19]) < 0 {
+		t.Fatalf("invalid UUIDv7 %s", s)
+	}
+	checkOrder(bucket, added)
+
+	generator, err := NewSnowflakeGenerator(7)
+	if err != nil {
+		t.Fatalf("can't create snowflake generator - err:%v", err)
+	}
+	opts = BucketOptsIntInt
+	opts.IDGenerator = generator
+	db.AddBucket("snowflakes", opts)
+	bucket = db.GetBucket("snowflakes")
+	last := int64(0)
+	for i := int64(0); i < 5000; i++ {
+		id, err := bucket.Add(i)
+		if err != nil || id <= last {
+			t.Fatalf("added %d after %d - err:%v", id, last, err)
+		}
+		if id>>12&1023 != 7 {
+			t.Fatalf("snowflake %d has node %d", id, id>>12&1023)
+		}
+		last = id
+	}
+	if _, err := NewSnowflakeGenerator(1024); err == nil {
+		t.Fatalf("created snowflake generator for node 1024")
+	}
+}
+
+func TestULIDString(t *testing.T) {
+	var id ULID
+	if s := id.String(); s != "00000000000000000000000000" {
+		t.Fatalf("zero ULID is %s", s)
+	}
+	for i := range id {
+		id[i] = 0xFF
+	}
+	if s := id.String(); s != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("max ULID is %s", s)
+	}
+	// the timestamp of the example of the ULID spec
+	id = ULID{0x01, 0x56, 0x3D, 0xF3, 0x64, 0x81}
+	if s := id.String(); s != "01ARYZ6S410000000000000000" {
+		t.Fatalf("ULID is %s", s)
+	}
+}
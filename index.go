@@ -0,0 +1,453 @@
+package puredb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// ErrDuplicate is returned when writing a record whose value for a unique
+// index is already taken by another record.
+var ErrDuplicate = errors.New("puredb: duplicate value for unique index")
+
+// IndexFn returns the value a record is indexed under, or nil if the
+// record is not in the index. It's called both with the values passed to
+// Add and Set and with the ones returned by UnmarshalValueFn.
+//
+// Indexed values can be nil, booleans, integers, floats, strings, byte
+// slices and time.Time.
+type IndexFn func(v interface{}) (interface{}, error)
+
+// IndexOpts describes a secondary index of a bucket.
+type IndexOpts struct {
+	Name   string
+	Fn     IndexFn
+	Unique bool
+	// Field, if set, is the field of the values the index is over, as
+	// named in queries: it tells the query planner that Fn returns that
+	// field, so that the index can serve the query filters on it.
+	Field string
+}
+
+// Index values are encoded so that their byte order is their natural
+// order: a type tag followed by a fixed-size big endian representation,
+// or, for strings and bytes, by their bytes with 0x00 escaped as 0x00 0xFF
+// and terminated by 0x00 0x01.
+//
+// Integers and floats share the same representation, so that a record
+// indexed under int(30) is found looking up float64(30), as returned by
+// many decoders: the value as a float64, followed by what the float64
+// lost of the integer.
+const (
+	indexTagNil byte = iota + 1
+	indexTagFalse
+	indexTagTrue
+	indexTagNumber
+	indexTagTime
+	indexTagString
+	indexTagBytes
+)
+
+func encodeIndexValue(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return []byte{indexTagNil}, nil
+	case bool:
+		if x {
+			return []byte{indexTagTrue}, nil
+		}
+		return []byte{indexTagFalse}, nil
+	case string:
+		return appendIndexBytes([]byte{indexTagString}, []byte(x)), nil
+	case []byte:
+		return appendIndexBytes([]byte{indexTagBytes}, x), nil
+	case time.Time:
+		b := make([]byte, 13)
+		b[0] = indexTagTime
+		binary.BigEndian.PutUint64(b[1:], uint64(x.Unix())^1<<63)
+		binary.BigEndian.PutUint32(b[9:], uint32(x.Nanosecond()))
+		return b, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeIndexInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("puredb: can't index %v, it overflows int64", u)
+		}
+		return encodeIndexInt(int64(u)), nil
+	case reflect.Float32, reflect.Float64:
+		return encodeIndexNumber(rv.Float(), 0), nil
+	case reflect.String:
+		return appendIndexBytes([]byte{indexTagString}, []byte(rv.String())), nil
+	case reflect.Bool:
+		return encodeIndexValue(rv.Bool())
+	}
+	return nil, fmt.Errorf("puredb: can't index values of type %T", v)
+}
+
+func encodeIndexInt(i int64) []byte {
+	f := float64(i)
+	var rest int64
+	if f >= math.MaxInt64 {
+		// f is 2^63, which doesn't fit an int64
+		rest = i + math.MinInt64
+	} else {
+		rest = i - int64(f)
+	}
+	return encodeIndexNumber(f, rest)
+}
+
+func encodeIndexNumber(f float64, rest int64) []byte {
+	// flip the sign bit of positive numbers and all bits of negative
+	// ones, so that they sort as unsigned integers
+	bits := math.Float64bits(f)
+	if f == 0 {
+		bits = 0
+	}
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b := make([]byte, 17)
+	b[0] = indexTagNumber
+	binary.BigEndian.PutUint64(b[1:], bits)
+	binary.BigEndian.PutUint64(b[9:], uint64(rest)^1<<63)
+	return b
+}
+
+func appendIndexBytes(b []byte, s []byte) []byte {
+	for _, c := range s {
+		if c == 0x00 {
+			b = append(b, 0x00, 0xFF)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, 0x00, 0x01)
+}
+
+func (bucket *Bucket) index(name string) (*IndexOpts, error) {
+	for i := range bucket.Opts.Indexes {
+		if bucket.Opts.Indexes[i].Name == name {
+			return &bucket.Opts.Indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("puredb: bucket %q has no index %q", bucket.Name, name)
+}
+
+func (bucket *Bucket) indexPrefix(name string) []byte {
+	return []byte(fmt.Sprintf("%sindex__%s__%s__", metaPrefix, bucket.Name, name))
+}
+
+// indexKey returns the key of the entry of the record with key k_b and
+// value v in index, or nil if the record is not in the index. Entries of
+// unique indexes are keyed by the indexed value alone, the others also by
+// the record key. The value of the entries is the record key.
+func (bucket *Bucket) indexKey(index *IndexOpts, k_b []byte, v interface{}) ([]byte, error) {
+	iv, err := index.Fn(v)
+	if err != nil || iv == nil {
+		return nil, err
+	}
+	enc, err := encodeIndexValue(iv)
+	if err != nil {
+		return nil, err
+	}
+	key := append(bucket.indexPrefix(index.Name), enc...)
+	if !index.Unique {
+		key = append(key, k_b...)
+	}
+	return key, nil
+}
+
+// reindex updates the index entries of the record with key k_b, about to
+// be set to v, or deleted if del is true. It must be called before
+// writing the record.
+func (bucket *Bucket) reindex(txn StorageTxn, k_b []byte, v interface{}, del bool) error {
+	if len(bucket.Opts.Indexes) == 0 {
+		return nil
+	}
+
+	var old interface{}
+	v_b, err := txn.Get(bucket.recordKey(k_b))
+	found := err == nil
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	if found {
+		if err := bucket.decodeValue(txn, k_b, v_b, &old); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !found && !del:
+		bucket.countRecords(txn, 1)
+	case found && del:
+		bucket.countRecords(txn, -1)
+	}
+
+	for i := range bucket.Opts.Indexes {
+		index := &bucket.Opts.Indexes[i]
+
+		var oldKey, newKey []byte
+		if found {
+			if oldKey, err = bucket.indexKey(index, k_b, old); err != nil {
+				return err
+			}
+		}
+		if !del {
+			if newKey, err = bucket.indexKey(index, k_b, v); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		switch {
+		case oldKey == nil:
+			bucket.countIndexEntries(txn, index.Name, 1)
+		case newKey == nil:
+			bucket.countIndexEntries(txn, index.Name, -1)
+		}
+
+		if oldKey != nil {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey == nil {
+			continue
+		}
+		if index.Unique {
+			owner, err := txn.Get(newKey)
+			if err == nil && !bytes.Equal(owner, k_b) {
+				return ErrDuplicate
+			}
+			if err != nil && err != ErrKeyNotFound {
+				return err
+			}
+		}
+		if err := txn.Set(newKey, k_b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the keys and values of the records indexed under v in
+// the named index.
+func (bucket *Bucket) Lookup(name string, v interface{}) ([]interface{}, []interface{}, error) {
+	db := bucket.DB
+	start := time.Now()
+
+	index, err := bucket.index(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, err := encodeIndexValue(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	entryPrefix := append(bucket.indexPrefix(name), enc...)
+
+	var keys []interface{}
+	var values []interface{}
+
+	err = db.view(func(txn StorageTxn) error {
+		var k_bs [][]byte
+		if index.Unique {
+			k_b, err := txn.Get(entryPrefix)
+			if err == ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			k_bs = append(k_bs, append([]byte(nil), k_b...))
+		} else {
+			opts := defaultIteratorOptions
+			it := txn.NewIterator(opts)
+			for it.Seek(entryPrefix); it.ValidForPrefix(entryPrefix); it.Next() {
+				k_b, err := it.Value()
+				if err != nil {
+					it.Close()
+					return err
+				}
+				k_bs = append(k_bs, append([]byte(nil), k_b...))
+			}
+			it.Close()
+		}
+
+		for _, k_b := range k_bs {
+			v_b, err := txn.Get(bucket.recordKey(k_b))
+			if err != nil {
+				return err
+			}
+			var k interface{}
+			var v interface{}
+			if err := bucket.UnmarshalKey(k_b, &k); err != nil {
+				return err
+			}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+		return nil
+	})
+
+	bucket.DB.logger.Debug("puredb: lookup", "bucket", bucket.Name, "index", name, "results", len(keys), "duration", time.Since(start), "err", err)
+	return keys, values, err
+}
+
+func (bucket *Bucket) checkIndexes() error {
+	if len(bucket.Opts.Indexes) > 0 && bucket.Opts.MergeFn != nil {
+		// merged values are not reindexed
+		return fmt.Errorf("puredb: bucket %q can't have both indexes and a merge function", bucket.Name)
+	}
+	names := make(map[string]bool)
+	for _, index := range bucket.Opts.Indexes {
+		if index.Name == "" || index.Fn == nil {
+			return fmt.Errorf("puredb: indexes of bucket %q need a name and a function", bucket.Name)
+		}
+		if names[index.Name] {
+			return fmt.Errorf("puredb: bucket %q has two indexes named %q", bucket.Name, index.Name)
+		}
+		names[index.Name] = true
+	}
+	return nil
+}
+
+// setupIndexes builds the indexes added since the last time the bucket was
+// set up, and removes the entries of the ones dropped.
+func (bucket *Bucket) setupIndexes() error {
+	db := bucket.DB
+
+	var meta bucketMeta
+	err := db.view(func(txn StorageTxn) error {
+		var err error
+		meta, _, err = bucket.loadMeta(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	built := make(map[string]bool)
+	for _, name := range meta.Indexes {
+		built[name] = true
+	}
+	var missing []*IndexOpts
+	for i := range bucket.Opts.Indexes {
+		if !built[bucket.Opts.Indexes[i].Name] {
+			missing = append(missing, &bucket.Opts.Indexes[i])
+		}
+		delete(built, bucket.Opts.Indexes[i].Name)
+	}
+	if len(missing) == 0 && len(built) == 0 {
+		return nil
+	}
+	if db.readOnly {
+		return fmt.Errorf("puredb: the indexes of bucket %q changed, can't update them read-only", bucket.Name)
+	}
+
+	for name := range built {
+		if err := db.deletePrefix(bucket.indexPrefix(name)); err != nil {
+			return err
+		}
+		db.logger.Info("puredb: dropped index", "bucket", bucket.Name, "index", name)
+	}
+
+	for _, index := range missing {
+		// remove what an interrupted build may have left
+		if err := db.deletePrefix(bucket.indexPrefix(index.Name)); err != nil {
+			return err
+		}
+		indexed, err := bucket.walkValues(context.Background(), nil, defaultMigrationBatchSize, func(txn StorageTxn, k_b []byte, v_b []byte) (bool, error) {
+			var v interface{}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return false, err
+			}
+			key, err := bucket.indexKey(index, k_b, v)
+			if err != nil || key == nil {
+				return false, err
+			}
+			if index.Unique {
+				_, err := txn.Get(key)
+				if err == nil {
+					return false, ErrDuplicate
+				}
+				if err != ErrKeyNotFound {
+					return false, err
+				}
+			}
+			return true, txn.Set(key, k_b)
+		}, nil)
+		if err != nil {
+			return err
+		}
+		db.logger.Info("puredb: built index", "bucket", bucket.Name, "index", index.Name, "entries", indexed)
+	}
+
+	return db.update(func(txn StorageTxn) error {
+		meta, _, err := bucket.loadMeta(txn)
+		if err != nil {
+			return err
+		}
+		meta.Indexes = nil
+		for _, index := range bucket.Opts.Indexes {
+			meta.Indexes = append(meta.Indexes, index.Name)
+		}
+		// the statistics of the indexes built or dropped are stale
+		if meta.Stats != nil {
+			for _, index := range missing {
+				delete(meta.Stats.Indexes, index.Name)
+			}
+			for name := range built {
+				delete(meta.Stats.Indexes, name)
+			}
+		}
+		return bucket.saveMeta(txn, meta)
+	})
+}
+
+// deletePrefix deletes all the keys starting with prefix, in batches.
+func (db *PureDB) deletePrefix(prefix []byte) error {
+	for {
+		var keys [][]byte
+		err := db.update(func(txn StorageTxn) error {
+			keys = nil
+			opts := defaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(keys) < defaultMigrationBatchSize; it.Next() {
+				keys = append(keys, append([]byte(nil), it.Key()...))
+			}
+			it.Close()
+
+			for _, k := range keys {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil || len(keys) < defaultMigrationBatchSize {
+			return err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package puredb
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIndexValueOrder(t *testing.T) {
+	t0 := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	ordered := [][]interface{}{
+		{math.Inf(-1), int64(math.MinInt64), -1000, -1.5, int8(-1), -0.25, 0, 0.25, uint8(1), float32(1.5), 1000},
+		{1 << 53, 1<<53 + 1, 1<<53 + 2, float64(1<<53 + 4), int64(math.MaxInt64 - 1), uint64(math.MaxInt64), math.Inf(1)},
+		{"", "\x00", "\x00\x00", "\x01", "a", "a\x00", "ab", "b"},
+		{t0.Add(-time.Hour), t0, t0.Add(time.Nanosecond), t0.Add(time.Second)},
+		{false, true},
+	}
+	for _, values := range ordered {
+		var prev []byte
+		for i, v := range values {
+			enc, err := encodeIndexValue(v)
+			if err != nil {
+				t.Fatalf("can't encode %v - err:%v", v, err)
+			}
+			if i > 0 && bytes.Compare(prev, enc) >= 0 {
+				t.Fatalf("%#v doesn't sort after %#v", v, values[i-1])
+			}
+			prev = enc
+		}
+	}
+
+	for _, pair := range [][]interface{}{{30, 30.0}, {uint16(7), float32(7)}, {0, math.Copysign(0, -1)}} {
+		a, _ := encodeIndexValue(pair[0])
+		b, _ := encodeIndexValue(pair[1])
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%#v and %#v are encoded differently", pair[0], pair[1])
+		}
+	}
+
+	if _, err := encodeIndexValue(struct{}{}); err == nil {
+		t.Fatal("expected an error indexing a struct")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	forEachBackend(t, testIndexes)
+}
+
+func testIndexes(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("docs", BucketOptsIntJSON)
+	bucket := db.GetBucket("docs")
+	for k, author := range []string{"Shakespeare", "Marlowe", "Shakespeare", "Jonson"} {
+		bucket.Set(int64(k), map[string]interface{}{"author": author, "code": k * 10})
+	}
+
+	field := func(name string) IndexFn {
+		return func(v interface{}) (interface{}, error) {
+			return v.(map[string]interface{})[name], nil
+		}
+	}
+
+	// indexes added to a bucket holding records are built
+	opts := BucketOptsIntJSON
+	opts.Indexes = []IndexOpts{
+		{Name: "author", Fn: field("author")},
+		{Name: "code", Fn: field("code"), Unique: true},
+	}
+	if err := db.AddBucket("docs", opts); err != nil {
+		t.Fatalf("can't add bucket with indexes - err:%v", err)
+	}
+	bucket = db.GetBucket("docs")
+
+	keys, _, err := bucket.Lookup("author", "Shakespeare")
+	if err != nil || len(keys) != 2 || keys[0] != int64(0) || keys[1] != int64(2) {
+		t.Fatalf("Lookup returned %v (err:%v)", keys, err)
+	}
+	// JSON numbers are decoded as float64
+	keys, _, _ = bucket.Lookup("code", 30.0)
+	if len(keys) != 1 || keys[0] != int64(3) {
+		t.Fatalf("unique Lookup returned %v", keys)
+	}
+
+	// indexes follow writes
+	if err := bucket.Set(int64(9), map[string]interface{}{"author": "Kyd", "code": 30}); err != ErrDuplicate {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+	bucket.Set(int64(2), map[string]interface{}{"author": "Marlowe", "code": 20})
+	bucket.Delete(int64(1))
+	bucket.Pop(false)
+	keys, _, _ = bucket.Lookup("author", "Shakespeare")
+	if len(keys) != 0 {
+		t.Fatalf("Lookup returned stale entries %v", keys)
+	}
+	keys, values, _ := bucket.Lookup("author", "Marlowe")
+	if len(keys) != 1 || keys[0] != int64(2) || values[0].(map[string]interface{})["code"] != 20.0 {
+		t.Fatalf("Lookup returned %v %v", keys, values)
+	}
+
+	// dropped indexes are removed
+	opts.Indexes = opts.Indexes[:1]
+	db.AddBucket("docs", opts)
+	db.view(func(txn StorageTxn) error {
+		it := txn.NewIterator(defaultIteratorOptions)
+		defer it.Close()
+		it.Seek(bucket.indexPrefix("code"))
+		if it.ValidForPrefix(bucket.indexPrefix("code")) {
+			t.Fatal("entries of dropped index were not removed")
+		}
+		return nil
+	})
+}
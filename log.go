@@ -0,0 +1,358 @@
+package puredb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logTrimBatchSize is the number of expired entries Trim deletes in each
+// transaction.
+const logTrimBatchSize = 1000
+
+// LogOpts are the options of a Log: those of its bucket, whose MaxEntries
+// and MaxBytes bound the size of the log, and its retention by age.
+type LogOpts struct {
+	BucketOpts
+
+	// MaxAge, if not zero, is how long entries are kept. Expired entries
+	// are skipped by reads, and deleted by Trim, which Append runs when
+	// the oldest entry expires.
+	MaxAge time.Duration
+
+	// Now, if not nil, is the clock timing the entries and their expiry,
+	// instead of time.Now.
+	Now func() time.Time
+}
+
+// LogEntry is an entry of a Log.
+type LogEntry struct {
+	Offset int64
+	Time   time.Time
+	Value  interface{}
+}
+
+// Log is an append-only log, whose entries are numbered by consecutive
+// offsets from 0. Its entries are the records of a bucket, keyed by their
+// offset, with the values of the bucket being LogEntry.
+//
+// Consumers keep track of what they have read by committing the offset to
+// resume from under the name of their group.
+type Log struct {
+	Bucket *Bucket
+	Opts   LogOpts
+
+	mu       sync.Mutex
+	appended chan struct{}
+	nextTrim time.Time
+
+	// waiting, if not nil, is called by ReadWait before waiting for an
+	// append.
+	waiting func()
+}
+
+// NewLog adds a bucket named name for the entries of a log to the
+// database. opts sets the value codecs, and the other options not about
+// keys.
+func NewLog(db *PureDB, name string, opts LogOpts) (*Log, error) {
+	bOpts := opts.BucketOpts
+	bOpts.MarshalKeyFn = BucketOptsIntInt.MarshalKeyFn
+	bOpts.UnmarshalKeyFn = BucketOptsIntInt.UnmarshalKeyFn
+	bOpts.IDGenerator = SequenceGenerator{GapFree: true}
+
+	// store the time of the entries before their values
+	marshal, unmarshal := bOpts.MarshalValueFn, bOpts.UnmarshalValueFn
+	bOpts.MarshalValueFn = func(v interface{}) ([]byte, error) {
+		entry, ok := v.(LogEntry)
+		if !ok {
+			return nil, fmt.Errorf("puredb: not a log entry: %v", v)
+		}
+		data, err := marshal(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		return append(i64tob(entry.Time.UnixNano()), data...), nil
+	}
+	bOpts.UnmarshalValueFn = func(data []byte, v *interface{}) error {
+		if len(data) < 8 {
+			return fmt.Errorf("puredb: invalid log entry length %d", len(data))
+		}
+		entry := LogEntry{Time: time.Unix(0, int64(binary.BigEndian.Uint64(data)))}
+		if err := unmarshal(data[8:], &entry.Value); err != nil {
+			return err
+		}
+		*v = entry
+		return nil
+	}
+
+	if err := db.AddBucket(name, bOpts); err != nil {
+		return nil, err
+	}
+	return &Log{Bucket: db.GetBucket(name), Opts: opts, appended: make(chan struct{})}, nil
+}
+
+// Append adds v at the end of the log, and returns its offset. Appends
+// conflicting with concurrent ones are retried.
+func (l *Log) Append(v interface{}) (int64, error) {
+	now := l.now()
+
+	var offset int64
+	var err error
+	for {
+		offset, err = l.Bucket.Add(LogEntry{Time: now, Value: v})
+		if err != ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// wake up the waiting reads
+	l.mu.Lock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+	trim := l.Opts.MaxAge > 0 && !now.Before(l.nextTrim)
+	l.mu.Unlock()
+
+	if trim {
+		if _, err := l.Trim(); err != nil {
+			l.Bucket.DB.logger.Error("puredb: can't trim log", "bucket", l.Bucket.Name, "err", err)
+		}
+	}
+	return offset, nil
+}
+
+// Read returns up to max entries, from the one at offset from, or the
+// first one after it if it was deleted.
+func (l *Log) Read(from int64, max int) ([]LogEntry, error) {
+	bucket := l.Bucket
+	db := bucket.DB
+	start := time.Now()
+
+	if from < 0 {
+		from = 0
+	}
+	if max <= 0 {
+		return nil, nil
+	}
+	var cutoff time.Time
+	if l.Opts.MaxAge > 0 {
+		cutoff = l.now().Add(-l.Opts.MaxAge)
+	}
+
+	var entries []LogEntry
+	err := db.view(func(txn StorageTxn) error {
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		opts := defaultIteratorOptions
+		if max < opts.PrefetchSize {
+			opts.PrefetchSize = max
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(bucket.recordKey(i64tob(from))); it.ValidForPrefix(prefix) && len(entries) < max; it.Next() {
+			k_b := it.Key()[len(prefix):]
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			var v interface{}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return err
+			}
+			entry := v.(LogEntry)
+			if entry.Time.Before(cutoff) {
+				continue
+			}
+			entry.Offset = int64(binary.BigEndian.Uint64(k_b))
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	db.logger.Debug("puredb: log read", "bucket", bucket.Name, "from", from, "entries", len(entries), "duration", time.Since(start), "err", err)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ReadWait is like Read, but waits for an entry to be appended while there
+// is none from offset from, until ctx is done. Only the appends made
+// through l wake it up.
+func (l *Log) ReadWait(ctx context.Context, from int64, max int) ([]LogEntry, error) {
+	for {
+		l.mu.Lock()
+		appended := l.appended
+		l.mu.Unlock()
+
+		entries, err := l.Read(from, max)
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+		if l.waiting != nil {
+			l.waiting()
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// groupKey is the key of the committed offset of a consumer group.
+func (l *Log) groupKey(group string) []byte {
+	return []byte(metaPrefix + "log_group__" + l.Bucket.Name + "__" + group)
+}
+
+// Commit records offset as the offset the consumer group named group
+// resumes reading from, usually the one after the last entry it handled.
+func (l *Log) Commit(group string, offset int64) error {
+	db := l.Bucket.DB
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	err := db.update(func(txn StorageTxn) error {
+		return txn.Set(l.groupKey(group), i64tob(offset))
+	})
+	db.logger.Debug("puredb: log commit", "bucket", l.Bucket.Name, "group", group, "offset", offset, "err", err)
+	return err
+}
+
+// Committed returns the offset committed by the consumer group named
+// group, 0 if it never committed one.
+func (l *Log) Committed(group string) (int64, error) {
+	var offset int64
+	err := l.Bucket.DB.view(func(txn StorageTxn) error {
+		v_b, err := txn.Get(l.groupKey(group))
+		switch {
+		case err == ErrKeyNotFound:
+			return nil
+		case err != nil:
+			return err
+		case len(v_b) != 8:
+			return fmt.Errorf("puredb: invalid offset of log consumer group %q", group)
+		}
+		offset = int64(binary.BigEndian.Uint64(v_b))
+		return nil
+	})
+	return offset, err
+}
+
+// ReadGroup is like ReadWait, from the offset committed by the consumer
+// group named group. It doesn't commit anything.
+func (l *Log) ReadGroup(ctx context.Context, group string, max int) ([]LogEntry, error) {
+	from, err := l.Committed(group)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadWait(ctx, from, max)
+}
+
+// Trim deletes the entries older than MaxAge, and returns how many it
+// deleted.
+func (l *Log) Trim() (int, error) {
+	bucket := l.Bucket
+	db := bucket.DB
+	start := time.Now()
+
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	if l.Opts.MaxAge <= 0 {
+		return 0, nil
+	}
+	now := l.now()
+	cutoff := now.Add(-l.Opts.MaxAge)
+
+	trimmed := 0
+	var oldest time.Time
+	for {
+		n := 0
+		err := db.update(func(txn StorageTxn) error {
+			n = 0
+			oldest = time.Time{}
+
+			// find the expired entries, then delete them once the
+			// iterator is closed
+			var expired [][]byte
+			err := func() error {
+				prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+				it := txn.NewIterator(defaultIteratorOptions)
+				defer it.Close()
+
+				for it.Seek(prefix); it.ValidForPrefix(prefix) && len(expired) < logTrimBatchSize; it.Next() {
+					k_b := it.Key()[len(prefix):]
+					v_b, err := it.Value()
+					if err != nil {
+						return err
+					}
+					var v interface{}
+					if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+						return err
+					}
+					if t := v.(LogEntry).Time; !t.Before(cutoff) {
+						oldest = t
+						break
+					}
+					expired = append(expired, append([]byte(nil), k_b...))
+				}
+				return nil
+			}()
+			if err != nil {
+				return err
+			}
+
+			for _, k_b := range expired {
+				if err := bucket.reindex(txn, k_b, nil, true); err != nil {
+					return err
+				}
+				if err := bucket.dropPending(txn, k_b); err != nil {
+					return err
+				}
+				if err := bucket.trackCapacity(txn, k_b, nil); err != nil {
+					return err
+				}
+				if err := txn.Delete(bucket.recordKey(k_b)); err != nil {
+					return err
+				}
+			}
+			n = len(expired)
+			return nil
+		})
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+		if n < logTrimBatchSize {
+			break
+		}
+	}
+
+	// nothing expires before the oldest entry left
+	l.mu.Lock()
+	if oldest.IsZero() {
+		l.nextTrim = now.Add(l.Opts.MaxAge)
+	} else {
+		l.nextTrim = oldest.Add(l.Opts.MaxAge)
+	}
+	l.mu.Unlock()
+
+	db.logger.Debug("puredb: log trim", "bucket", bucket.Name, "entries", trimmed, "duration", time.Since(start))
+	return trimmed, nil
+}
+
+// now returns the current time of the clock of the log.
+func (l *Log) now() time.Time {
+	if l.Opts.Now != nil {
+		return l.Opts.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,112 @@
+package puredb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	forEachBackend(t, testLog)
+}
+
+func testLog(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	l, err := NewLog(db, "events", LogOpts{BucketOpts: BucketOptsIntInt})
+	if err != nil {
+		t.Fatalf("can't create log - err:%v", err)
+	}
+	for i := 0; i < 5; i++ {
+		offset, err := l.Append(int64(i * 10))
+		if err != nil || offset != int64(i) {
+			t.Fatalf("appended at offset %d - err:%v", offset, err)
+		}
+	}
+
+	entries, err := l.Read(2, 2)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("read %d entries - err:%v", len(entries), err)
+	}
+	if entries[0].Offset != 2 || entries[0].Value != int64(20) || entries[1].Offset != 3 {
+		t.Fatalf("read %+v", entries)
+	}
+	if entries, err := l.Read(5, 10); err != nil || len(entries) != 0 {
+		t.Fatalf("read %d entries past the end - err:%v", len(entries), err)
+	}
+
+	// consumer groups
+	if offset, err := l.Committed("mailer"); err != nil || offset != 0 {
+		t.Fatalf("new group at offset %d - err:%v", offset, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries, err = l.ReadGroup(ctx, "mailer", 3)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("group read %d entries - err:%v", len(entries), err)
+	}
+	if err := l.Commit("mailer", entries[2].Offset+1); err != nil {
+		t.Fatalf("can't commit - err:%v", err)
+	}
+	entries, err = l.ReadGroup(ctx, "mailer", 3)
+	if err != nil || len(entries) != 2 || entries[0].Offset != 3 {
+		t.Fatalf("group read %+v after commit - err:%v", entries, err)
+	}
+	if offset, err := l.Committed("auditor"); err != nil || offset != 0 {
+		t.Fatalf("other group at offset %d - err:%v", offset, err)
+	}
+
+	// long-poll reads
+	waiting := make(chan struct{})
+	l.waiting = func() { close(waiting) }
+	done := make(chan []LogEntry)
+	go func() {
+		entries, err := l.ReadWait(ctx, 5, 10)
+		if err != nil {
+			t.Errorf("can't wait for entries - err:%v", err)
+		}
+		done <- entries
+	}()
+	<-waiting
+	l.waiting = nil
+	if _, err := l.Append(int64(50)); err != nil {
+		t.Fatalf("can't append - err:%v", err)
+	}
+	if entries := <-done; len(entries) != 1 || entries[0].Offset != 5 {
+		t.Fatalf("waited for %+v", entries)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := l.ReadWait(short, 6, 10); err != context.DeadlineExceeded {
+		t.Fatalf("waited past the deadline - err:%v", err)
+	}
+
+	// retention
+	now := time.Unix(1000, 0)
+	opts := LogOpts{BucketOpts: BucketOptsIntInt, MaxAge: time.Minute}
+	opts.Now = func() time.Time { return now }
+	opts.MaxEntries = 3
+	l, err = NewLog(db, "recent", opts)
+	if err != nil {
+		t.Fatalf("can't create log - err:%v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(int64(i)); err != nil {
+			t.Fatalf("can't append %d - err:%v", i, err)
+		}
+	}
+	if entries, err := l.Read(0, 10); err != nil || len(entries) != 3 || entries[0].Offset != 2 {
+		t.Fatalf("capped log holds %+v - err:%v", entries, err)
+	}
+	now = now.Add(2 * time.Minute)
+	if entries, err := l.Read(0, 10); err != nil || len(entries) != 0 {
+		t.Fatalf("read %d expired entries - err:%v", len(entries), err)
+	}
+	if _, err := l.Append(int64(5)); err != nil {
+		t.Fatalf("can't append - err:%v", err)
+	}
+	if n, err := l.Bucket.Count(); err != nil || n != 1 {
+		t.Fatalf("%d entries left after trimming - err:%v", n, err)
+	}
+}
@@ -0,0 +1,43 @@
+package puredb
+
+// Logger is the logging interface used by PureDB.
+//
+// The method set is a subset of the one of *slog.Logger, so a *slog.Logger
+// can be passed as-is to WithLogger. The variadic arguments are alternating
+// key/value pairs, as in log/slog.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger is the default logger: PureDB is silent unless a Logger is
+// configured with WithLogger.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// WithLogger sets the logger used by the database and its buckets.
+//
+// Only PureDB's own messages go through this logger. Badger v1.5 has no
+// logger hook: it writes to the standard log package, for instance when
+// replaying or rewriting the value log, and calls log.Fatal on some
+// compaction failures, none of which can be redirected here.
+func WithLogger(logger Logger) PureDBOptionFn {
+	return func(db *PureDB) error {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		db.logger = logger
+		return nil
+	}
+}
+
+// Logger returns the logger configured for the database.
+func (db *PureDB) Logger() Logger {
+	return db.logger
+}
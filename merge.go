@@ -0,0 +1,410 @@
+package puredb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// MergeFn combines the value v of a record with an operand passed to
+// Merge, returning the new value. v is nil if there is no record yet.
+type MergeFn func(v interface{}, operand interface{}) (interface{}, error)
+
+// MergeAddInt64 adds integer operands to integer values, returning an
+// int64.
+func MergeAddInt64(v interface{}, operand interface{}) (interface{}, error) {
+	sum := int64(0)
+	if v != nil {
+		i, err := toInt64(v)
+		if err != nil {
+			return nil, err
+		}
+		sum = i
+	}
+	i, err := toInt64(operand)
+	if err != nil {
+		return nil, err
+	}
+	return sum + i, nil
+}
+
+// MergeAppend appends operands to list values, returning a []interface{}.
+func MergeAppend(v interface{}, operand interface{}) (interface{}, error) {
+	list, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(list, operand), nil
+}
+
+// MergeUnion adds operands to set values, kept as lists in the order the
+// elements were added, unless they are there already. Elements are
+// compared like index values, so they can be nil, booleans, numbers,
+// strings, byte slices or times. It returns a []interface{}.
+func MergeUnion(v interface{}, operand interface{}) (interface{}, error) {
+	set, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encodeIndexValue(operand)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range set {
+		e_enc, err := encodeIndexValue(e)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(e_enc, enc) {
+			return set, nil
+		}
+	}
+	return append(set, operand), nil
+}
+
+func toInt64(v interface{}) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+		return rv.Int(), nil
+	case isIntKind(rv.Kind()):
+		return int64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("puredb: %v is a %T, not an integer", v, v)
+}
+
+func toList(v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("puredb: %v is a %T, not a list", v, v)
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, nil
+}
+
+// Merge records operand to be combined with the value of the record with
+// key k by the MergeFn of the bucket. Merges only write the operand, so
+// they never conflict with each other: Get applies the operands recorded
+// since the last compaction on read, while the other reads see the records
+// as of the last compaction (see MergeFn). Operands are compacted into the
+// records by CompactMerges, and every MergeCompactInterval if set.
+//
+// Set, Delete, Pop and Incr discard the operands of the records they
+// write.
+func (bucket *Bucket) Merge(k interface{}, operand interface{}) error {
+	db := bucket.DB
+	start := time.Now()
+
+	if bucket.Opts.MergeFn == nil {
+		return fmt.Errorf("puredb: bucket %q has no merge function", bucket.Name)
+	}
+	if bucket.mergeSeq == nil {
+		return ErrReadOnly
+	}
+
+	k_b, err := bucket.MarshalKey(k)
+	if err != nil {
+		return err
+	}
+
+	err = db.update(func(txn StorageTxn) error {
+		num, err := bucket.mergeSeq.Next()
+		if err != nil {
+			return err
+		}
+		v_b, err := bucket.encodeFramed(k_b, operand)
+		if err != nil {
+			return err
+		}
+		return txn.Set(append(bucket.mergeKeyPrefix(k_b), u64tob(num)...), v_b)
+	})
+
+	bucket.logOp("merge", start, len(k_b), err)
+	return err
+}
+
+// mergePrefix starts the keys of the merge operands of the bucket. They
+// are followed by the escaped key of the record, like index values, and
+// by the merge sequence number, so that the operands of a record are
+// contiguous and in the order they were recorded.
+func (bucket *Bucket) mergePrefix() []byte {
+	return []byte(metaPrefix + "merge__" + bucket.Name + "__")
+}
+
+func (bucket *Bucket) mergeKeyPrefix(k_b []byte) []byte {
+	return appendIndexBytes(bucket.mergePrefix(), k_b)
+}
+
+// pendingMerges returns the keys and the values of the merge operands of
+// the record with key k_b.
+func (bucket *Bucket) pendingMerges(txn StorageTxn, k_b []byte) ([][]byte, [][]byte, error) {
+	prefix := bucket.mergeKeyPrefix(k_b)
+
+	var keys [][]byte
+	var operands [][]byte
+	it := txn.NewIterator(defaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		v_b, err := it.Value()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, append([]byte(nil), it.Key()...))
+		operands = append(operands, append([]byte(nil), v_b...))
+	}
+	return keys, operands, nil
+}
+
+// applyMerges combines v with the operands of the record with key k_b.
+func (bucket *Bucket) applyMerges(k_b []byte, v interface{}, operands [][]byte) (interface{}, error) {
+	for _, v_b := range operands {
+		var operand interface{}
+		if err := bucket.decodeFramed(k_b, v_b, &operand); err != nil {
+			return nil, err
+		}
+		var err error
+		v, err = bucket.Opts.MergeFn(v, operand)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// getMerged decodes the value v_b of the record with key k_b, if found,
+// and combines it with its merge operands. It returns ErrKeyNotFound if
+// there is neither.
+func (bucket *Bucket) getMerged(txn StorageTxn, k_b []byte, v_b []byte, found bool, v *interface{}) error {
+	if found {
+		if err := bucket.decodeValue(txn, k_b, v_b, v); err != nil {
+			return err
+		}
+	}
+	_, operands, err := bucket.pendingMerges(txn, k_b)
+	if err != nil {
+		return err
+	}
+	if !found && len(operands) == 0 {
+		return ErrKeyNotFound
+	}
+	*v, err = bucket.applyMerges(k_b, *v, operands)
+	return err
+}
+
+// dropMerges discards the merge operands of the record with key k_b.
+func (bucket *Bucket) dropMerges(txn StorageTxn, k_b []byte) error {
+	if bucket.Opts.MergeFn == nil {
+		return nil
+	}
+	keys, _, err := bucket.pendingMerges(txn, k_b)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactMerges combines the pending merge operands into the records, and
+// returns the number of records written. Each record is compacted in its
+// own transaction.
+func (bucket *Bucket) CompactMerges(ctx context.Context) (int, error) {
+	db := bucket.DB
+	if bucket.Opts.MergeFn == nil {
+		return 0, fmt.Errorf("puredb: bucket %q has no merge function", bucket.Name)
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	start := time.Now()
+
+	prefix := bucket.mergePrefix()
+	next := prefix
+	compacted := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return compacted, err
+		}
+
+		// find the key of the next record with operands
+		var k_b []byte
+		err := db.view(func(txn StorageTxn) error {
+			opts := defaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			it.Seek(next)
+			if !it.ValidForPrefix(prefix) {
+				return nil
+			}
+			var err error
+			k_b, err = unescapeMergeKey(it.Key()[len(prefix):])
+			return err
+		})
+		if err != nil {
+			return compacted, err
+		}
+		if k_b == nil {
+			break
+		}
+
+		err = db.update(func(txn StorageTxn) error {
+			return bucket.compactMerges(txn, k_b)
+		})
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return compacted, err
+		}
+		compacted++
+		next = prefixEnd(bucket.mergeKeyPrefix(k_b))
+	}
+
+	db.logger.Debug("puredb: compact merges", "bucket", bucket.Name, "records", compacted, "duration", time.Since(start))
+	return compacted, nil
+}
+
+// compactMerges combines the merge operands of the record with key k_b
+// into it.
+func (bucket *Bucket) compactMerges(txn StorageTxn, k_b []byte) error {
+	keys, operands, err := bucket.pendingMerges(txn, k_b)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	k_prefixed := bucket.recordKey(k_b)
+	var v interface{}
+	found := true
+	v_b, err := txn.Get(k_prefixed)
+	switch {
+	case err == ErrKeyNotFound:
+		found = false
+	case err != nil:
+		return err
+	default:
+		if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+			return err
+		}
+	}
+
+	v, err = bucket.applyMerges(k_b, v, operands)
+	if err != nil {
+		return err
+	}
+	v_b, err = bucket.encodeValue(txn, k_b, v)
+	if err != nil {
+		return err
+	}
+	if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
+		return err
+	}
+	if err := txn.Set(k_prefixed, v_b); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	if !found {
+		bucket.countRecords(txn, 1)
+	}
+	return nil
+}
+
+// unescapeMergeKey returns the record key at the start of a merge operand
+// key, stripped of the merge prefix.
+func unescapeMergeKey(b []byte) ([]byte, error) {
+	k_b := []byte{}
+	for i := 0; i+1 < len(b); i++ {
+		if b[i] != 0x00 {
+			k_b = append(k_b, b[i])
+			continue
+		}
+		switch b[i+1] {
+		case 0x01:
+			return k_b, nil
+		case 0xFF:
+			k_b = append(k_b, 0x00)
+			i++
+		default:
+			return nil, fmt.Errorf("puredb: invalid merge operand key")
+		}
+	}
+	return nil, fmt.Errorf("puredb: invalid merge operand key")
+}
+
+// setupMerges leases the merge sequence and, with MergeCompactInterval,
+// starts compacting the merge operands in the background.
+func (bucket *Bucket) setupMerges() error {
+	db := bucket.DB
+	if bucket.Opts.MergeFn == nil || db.readOnly {
+		return nil
+	}
+
+	seq, err := db.storage.GetSequence([]byte(metaPrefix+"merge_seq__"+bucket.Name), db.seqBandwidth)
+	if err != nil {
+		return err
+	}
+	bucket.mergeSeq = seq
+
+	interval := bucket.Opts.MergeCompactInterval
+	if interval <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket.stopCompaction = cancel
+	bucket.compactionWG.Add(1)
+	go func() {
+		defer bucket.compactionWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := bucket.CompactMerges(ctx); err != nil && ctx.Err() == nil {
+					db.logger.Error("puredb: can't compact merges", "bucket", bucket.Name, "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// cleanupMerges stops the background compaction and releases the merge
+// sequence.
+func (bucket *Bucket) cleanupMerges() {
+	if bucket.stopCompaction != nil {
+		bucket.stopCompaction()
+		bucket.compactionWG.Wait()
+		bucket.stopCompaction = nil
+	}
+	if bucket.mergeSeq != nil {
+		bucket.mergeSeq.Release()
+		bucket.mergeSeq = nil
+	}
+}
+
+// mergeState is the state of the merge operands of a bucket.
+type mergeState struct {
+	mergeSeq       StorageSequence
+	stopCompaction context.CancelFunc
+	compactionWG   sync.WaitGroup
+}
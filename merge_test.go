@@ -0,0 +1,128 @@
+package puredb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestMerge(t *testing.T) {
+	forEachBackend(t, testMerge)
+}
+
+func testMerge(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntInt
+	opts.MergeFn = MergeAddInt64
+	db.AddBucket("counters", opts)
+	bucket := db.GetBucket("counters")
+	if bucket.stopCompaction != nil {
+		t.Fatalf("compacting in the background without MergeCompactInterval")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := bucket.Merge(int64(1), int64(1)); err != nil {
+					t.Errorf("can't merge - err:%v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	bucket.Merge(int64(2), int64(-5))
+
+	if v, err := bucket.Get(int64(1)); err != nil || v != int64(100) {
+		t.Fatalf("merged counter is %v - err:%v", v, err)
+	}
+	if n, _ := bucket.Count(); n != 0 {
+		t.Fatalf("%d records before compaction", n)
+	}
+	if compacted, err := bucket.CompactMerges(context.Background()); err != nil || compacted != 2 {
+		t.Fatalf("compacted %d records - err:%v", compacted, err)
+	}
+	if v, err := bucket.Get(int64(1)); err != nil || v != int64(100) {
+		t.Fatalf("compacted counter is %v - err:%v", v, err)
+	}
+	if n, _ := bucket.Count(); n != 2 {
+		t.Fatalf("%d records after compaction", n)
+	}
+	if compacted, _ := bucket.CompactMerges(context.Background()); compacted != 0 {
+		t.Fatalf("compacted %d records again", compacted)
+	}
+
+	// Set and Delete discard the pending operands
+	bucket.Merge(int64(1), int64(7))
+	bucket.Set(int64(1), int64(3))
+	bucket.Merge(int64(1), int64(1))
+	if v, err := bucket.Get(int64(1)); err != nil || v != int64(4) {
+		t.Fatalf("counter is %v after set - err:%v", v, err)
+	}
+	bucket.Delete(int64(1))
+	if _, err := bucket.Get(int64(1)); err != ErrKeyNotFound {
+		t.Fatalf("deleted counter - err:%v", err)
+	}
+	bucket.Merge(int64(2), int64(1))
+	if k, _, err := bucket.Pop(false); err != nil || k != int64(2) {
+		t.Fatalf("popped %v - err:%v", k, err)
+	}
+	if _, err := bucket.Get(int64(2)); err != ErrKeyNotFound {
+		t.Fatalf("popped counter - err:%v", err)
+	}
+
+	if err := db.AddBucket("indexed", BucketOpts{
+		MarshalKeyFn:     opts.MarshalKeyFn,
+		UnmarshalKeyFn:   opts.UnmarshalKeyFn,
+		MarshalValueFn:   opts.MarshalValueFn,
+		UnmarshalValueFn: opts.UnmarshalValueFn,
+		MergeFn:          MergeAddInt64,
+		Indexes:          []IndexOpts{{Name: "value", Fn: func(v interface{}) (interface{}, error) { return v, nil }}},
+	}); err == nil {
+		t.Fatalf("added bucket with indexes and merge function")
+	}
+
+	// lists and sets, compacted in the background
+	opts = BucketOptsIntInt
+	opts.MarshalValueFn = func(v interface{}) ([]byte, error) {
+		return msgpack.Marshal(v)
+	}
+	opts.UnmarshalValueFn = func(data []byte, v *interface{}) error {
+		return msgpack.Unmarshal(data, v)
+	}
+	opts.MergeFn = MergeUnion
+	opts.MergeCompactInterval = 10 * time.Millisecond
+	db.AddBucket("tags", opts)
+	tags := db.GetBucket("tags")
+	for _, tag := range []string{"go", "db", "go", "kv"} {
+		tags.Merge(int64(1), tag)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := tags.Count(); n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("merges not compacted in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := tags.Get(int64(1)); err != nil || fmt.Sprint(v) != "[go db kv]" {
+		t.Fatalf("tags are %v - err:%v", v, err)
+	}
+
+	if v, _ := MergeAppend([]interface{}{"a"}, "a"); fmt.Sprint(v) != "[a a]" {
+		t.Fatalf("appended %v", v)
+	}
+	if _, err := MergeAddInt64("a", int64(1)); err == nil {
+		t.Fatalf("added to a string")
+	}
+}
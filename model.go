@@ -0,0 +1,247 @@
+package puredb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Model maps the struct type T to a bucket, so that its values can be
+// stored without writing BucketOpts by hand. The mapping is driven by the
+// puredb tags of the fields of T:
+//
+//	puredb:"id"                 the field is the primary key
+//	puredb:"id,auto"            same, and Save assigns it from the bucket
+//	                            sequence when it's zero
+//	puredb:"index=name"         the field is indexed in the index name
+//	puredb:"index=name,unique"  same, in a unique index
+//
+// Primary keys can be integers, strings, byte slices or time.Time, and
+// auto-assigned ones integers. Values are stored with msgpack.
+type Model[T any] struct {
+	Bucket *Bucket
+
+	id   []int
+	auto bool
+}
+
+// NewModel adds a bucket named name for the values of T to the database.
+// opts can set the options not derived from T, like Compression: its
+// codecs and PreAddFn are replaced, and the indexes of T are added to its
+// Indexes.
+func NewModel[T any](db *PureDB, name string, opts BucketOpts) (*Model[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("puredb: model type %v is not a struct", t)
+	}
+
+	m := &Model[T]{}
+	var idType reflect.Type
+	indexes := append([]IndexOpts(nil), opts.Indexes...)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("puredb")
+		if !ok {
+			continue
+		}
+		if field.PkgPath != "" {
+			return nil, fmt.Errorf("puredb: model field %v.%s is not exported", t, field.Name)
+		}
+
+		var index *IndexOpts
+		for _, option := range strings.Split(tag, ",") {
+			switch {
+			case option == "id":
+				if m.id != nil {
+					return nil, fmt.Errorf("puredb: model type %v has two id fields", t)
+				}
+				m.id = field.Index
+				idType = field.Type
+			case option == "auto":
+				m.auto = true
+			case strings.HasPrefix(option, "index="):
+				index = &IndexOpts{Name: strings.TrimPrefix(option, "index="), Field: field.Name}
+			case option == "unique":
+				if index == nil {
+					return nil, fmt.Errorf("puredb: model field %v.%s is unique but not indexed", t, field.Name)
+				}
+				index.Unique = true
+			default:
+				return nil, fmt.Errorf("puredb: unknown option %q in tag of model field %v.%s", option, t, field.Name)
+			}
+		}
+		if index != nil {
+			index.Fn = fieldFn(field.Index)
+			indexes = append(indexes, *index)
+		}
+	}
+
+	if m.id == nil {
+		return nil, fmt.Errorf("puredb: model type %v has no field tagged puredb:\"id\"", t)
+	}
+	if m.auto && !isIntKind(idType.Kind()) {
+		return nil, fmt.Errorf("puredb: auto-assigned id of model type %v must be an integer", t)
+	}
+	keyFns, err := modelKeyFns(idType)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.MarshalKeyFn = keyFns.MarshalKeyFn
+	opts.UnmarshalKeyFn = keyFns.UnmarshalKeyFn
+	opts.MarshalValueFn = func(v interface{}) ([]byte, error) {
+		return msgpack.Marshal(v)
+	}
+	opts.UnmarshalValueFn = func(data []byte, v *interface{}) error {
+		value := new(T)
+		if err := msgpack.Unmarshal(data, value); err != nil {
+			return err
+		}
+		*v = value
+		return nil
+	}
+	opts.PreAddFn = nil
+	opts.Indexes = indexes
+
+	if err := db.AddBucket(name, opts); err != nil {
+		return nil, err
+	}
+	m.Bucket = db.GetBucket(name)
+	return m, nil
+}
+
+// Save stores v, first assigning it an id if it's auto-assigned and zero.
+func (m *Model[T]) Save(v *T) error {
+	id := reflect.ValueOf(v).Elem().FieldByIndex(m.id)
+	if m.auto && id.IsZero() {
+		if m.Bucket.Seq == nil {
+			return ErrReadOnly
+		}
+		num, err := m.Bucket.Seq.Next()
+		if err == nil && num == 0 {
+			// zero means unassigned
+			num, err = m.Bucket.Seq.Next()
+		}
+		if err != nil {
+			return err
+		}
+		if id.Kind() >= reflect.Uint && id.Kind() <= reflect.Uintptr {
+			id.SetUint(num)
+		} else {
+			id.SetInt(int64(num))
+		}
+	}
+	return m.Bucket.Set(id.Interface(), v)
+}
+
+// Load returns the value with the given id, or ErrKeyNotFound.
+func (m *Model[T]) Load(id interface{}) (*T, error) {
+	v, err := m.Bucket.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*T), nil
+}
+
+// Delete deletes the value with the given id.
+func (m *Model[T]) Delete(id interface{}) error {
+	return m.Bucket.Delete(id)
+}
+
+// Find returns the values whose field indexed in the named index equals
+// value.
+func (m *Model[T]) Find(index string, value interface{}) ([]*T, error) {
+	_, values, err := m.Bucket.Lookup(index, value)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]*T, len(values))
+	for i, v := range values {
+		found[i] = v.(*T)
+	}
+	return found, nil
+}
+
+// fieldFn returns an IndexFn extracting a field from structs or pointers
+// to structs.
+func fieldFn(index []int) IndexFn {
+	return func(v interface{}) (interface{}, error) {
+		return reflect.Indirect(reflect.ValueOf(v)).FieldByIndex(index).Interface(), nil
+	}
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uintptr
+}
+
+// modelKeyFns returns the key codecs for ids of type t. Integers are
+// stored like the ids assigned by Bucket.Add.
+func modelKeyFns(t reflect.Type) (BucketOpts, error) {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return BucketOpts{
+			MarshalKeyFn:   BucketOptsTimeInt.MarshalKeyFn,
+			UnmarshalKeyFn: BucketOptsTimeInt.UnmarshalKeyFn,
+		}, nil
+	case isIntKind(t.Kind()):
+		return BucketOpts{
+			MarshalKeyFn: func(v interface{}) ([]byte, error) {
+				rv := reflect.ValueOf(v)
+				switch {
+				case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+					return i64tob(rv.Int()), nil
+				case isIntKind(rv.Kind()):
+					return u64tob(rv.Uint()), nil
+				}
+				return nil, fmt.Errorf("puredb: not a valid integer id: %v", v)
+			},
+			UnmarshalKeyFn: func(data []byte, v *interface{}) error {
+				if len(data) != 8 {
+					return fmt.Errorf("puredb: invalid integer id length %d", len(data))
+				}
+				id := reflect.New(t).Elem()
+				if t.Kind() >= reflect.Uint {
+					id.SetUint(binary.BigEndian.Uint64(data))
+				} else {
+					id.SetInt(int64(binary.BigEndian.Uint64(data)))
+				}
+				*v = id.Interface()
+				return nil
+			},
+		}, nil
+	case t.Kind() == reflect.String:
+		return BucketOpts{
+			MarshalKeyFn: func(v interface{}) ([]byte, error) {
+				rv := reflect.ValueOf(v)
+				if rv.Kind() != reflect.String {
+					return nil, fmt.Errorf("puredb: not a valid string id: %v", v)
+				}
+				return []byte(rv.String()), nil
+			},
+			UnmarshalKeyFn: func(data []byte, v *interface{}) error {
+				*v = reflect.ValueOf(string(data)).Convert(t).Interface()
+				return nil
+			},
+		}, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return BucketOpts{
+			MarshalKeyFn: func(v interface{}) ([]byte, error) {
+				rv := reflect.ValueOf(v)
+				if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() != reflect.Uint8 {
+					return nil, fmt.Errorf("puredb: not a valid bytes id: %v", v)
+				}
+				return rv.Bytes(), nil
+			},
+			UnmarshalKeyFn: func(data []byte, v *interface{}) error {
+				*v = reflect.ValueOf(append([]byte(nil), data...)).Convert(t).Interface()
+				return nil
+			},
+		}, nil
+	}
+	return BucketOpts{}, fmt.Errorf("puredb: can't use %v as model id", t)
+}
@@ -0,0 +1,72 @@
+package puredb
+
+import (
+	"testing"
+)
+
+type modelBook struct {
+	Id     int64  `puredb:"id,auto"`
+	ISBN   string `puredb:"index=isbn,unique"`
+	Author string `puredb:"index=author"`
+	Title  string
+	Year   int
+}
+
+func TestModel(t *testing.T) {
+	forEachBackend(t, testModel)
+}
+
+func testModel(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	if _, err := NewModel[struct{ Title string }](db, "untagged", BucketOpts{}); err == nil {
+		t.Fatal("expected an error for a model without id")
+	}
+
+	books, err := NewModel[modelBook](db, "books", BucketOpts{Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatalf("can't create model - err:%v", err)
+	}
+
+	hamlet := &modelBook{ISBN: "1", Author: "Shakespeare", Title: "Hamlet", Year: 1603}
+	for _, book := range []*modelBook{
+		hamlet,
+		{ISBN: "2", Author: "Marlowe", Title: "Doctor Faustus", Year: 1604},
+		{ISBN: "3", Author: "Shakespeare", Title: "Macbeth", Year: 1623},
+	} {
+		if err := books.Save(book); err != nil {
+			t.Fatalf("can't save %v - err:%v", book, err)
+		}
+	}
+	if hamlet.Id == 0 {
+		t.Fatal("id was not assigned")
+	}
+
+	loaded, err := books.Load(hamlet.Id)
+	if err != nil || *loaded != *hamlet {
+		t.Fatalf("Load returned %v, expected %v (err:%v)", loaded, hamlet, err)
+	}
+
+	found, err := books.Find("author", "Shakespeare")
+	if err != nil || len(found) != 2 || found[0].Title != "Hamlet" || found[1].Title != "Macbeth" {
+		t.Fatalf("Find returned %v (err:%v)", found, err)
+	}
+
+	if err := books.Save(&modelBook{ISBN: "1", Title: "Hamlet, again"}); err != ErrDuplicate {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+
+	hamlet.Author = "Anonymous"
+	books.Save(hamlet)
+	books.Delete(found[1].Id)
+	if found, _ := books.Find("author", "Shakespeare"); len(found) != 0 {
+		t.Fatalf("Find returned stale values %v", found)
+	}
+	if found, _ := books.Find("isbn", "1"); len(found) != 1 || found[0].Author != "Anonymous" {
+		t.Fatalf("Find returned %v", found)
+	}
+	if _, err := books.Load(found[1].Id); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound for deleted value, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package puredb
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	defaultSequenceBandwidth = 100
+
+	// DefaultEncryptionKeyID is the ID of the key set with
+	// WithEncryptionKey.
+	DefaultEncryptionKeyID = "default"
+
+	minValueLogFileSize = 1 << 20
+	maxValueLogFileSize = 2 << 30
+)
+
+var (
+	// ErrReadOnly is returned by write operations on a database opened
+	// with WithReadOnly.
+	ErrReadOnly = errors.New("puredb: database is read-only")
+)
+
+// WithSyncWrites controls whether every write is synced to disk before the
+// transaction is acknowledged. Open enables it by default.
+func WithSyncWrites(sync bool) PureDBOptionFn {
+	return func(db *PureDB) error {
+		db.badgerOpts.SyncWrites = sync
+		return nil
+	}
+}
+
+// WithReadOnly opens an existing database in read-only mode. Bucket
+// sequences are not leased, and write operations fail with ErrReadOnly or
+// with the error of the underlying storage.
+func WithReadOnly() PureDBOptionFn {
+	return func(db *PureDB) error {
+		if db.inMemory {
+			return fmt.Errorf("puredb: WithReadOnly can't be combined with WithInMemory")
+		}
+		db.readOnly = true
+		db.badgerOpts.ReadOnly = true
+		return nil
+	}
+}
+
+// WithInMemory keeps the whole database in memory: nothing is written to
+// disk and the pathname passed to Open is ignored.
+func WithInMemory() PureDBOptionFn {
+	return func(db *PureDB) error {
+		if db.readOnly {
+			return fmt.Errorf("puredb: WithInMemory can't be combined with WithReadOnly")
+		}
+		db.inMemory = true
+		return nil
+	}
+}
+
+// WithValueLogFileSize sets the maximum size in bytes of a single value log
+// file. Badger accepts sizes between 1MB and 2GB.
+func WithValueLogFileSize(size int64) PureDBOptionFn {
+	return func(db *PureDB) error {
+		if size < minValueLogFileSize || size > maxValueLogFileSize {
+			return fmt.Errorf("puredb: invalid value log file size %d, must be between %d and %d bytes",
+				size, int64(minValueLogFileSize), int64(maxValueLogFileSize))
+		}
+		db.badgerOpts.ValueLogFileSize = size
+		return nil
+	}
+}
+
+// WithSequenceBandwidth sets how many IDs each bucket sequence leases at a
+// time. Larger values mean fewer writes on Add, but larger gaps in the IDs
+// after a restart.
+func WithSequenceBandwidth(n uint64) PureDBOptionFn {
+	return func(db *PureDB) error {
+		if n == 0 {
+			return fmt.Errorf("puredb: invalid sequence bandwidth 0, must be at least 1")
+		}
+		db.seqBandwidth = n
+		return nil
+	}
+}
+
+// WithEncryptionKey sets the database key: an AES key (16, 24 or 32 bytes,
+// for AES-128, AES-192 or AES-256) that buckets opt in to by setting their
+// Encryption to DatabaseKey, as if they had a KeyRing holding only this
+// key, with ID DefaultEncryptionKeyID. It doesn't encrypt the storage
+// itself: the other buckets, the keys of the records and PureDB's own
+// records are stored in clear.
+func WithEncryptionKey(key []byte) PureDBOptionFn {
+	return func(db *PureDB) error {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("puredb: invalid encryption key length %d, must be 16, 24 or 32 bytes", len(key))
+		}
+		ring, err := NewKeyRing(DefaultEncryptionKeyID, key)
+		if err != nil {
+			return err
+		}
+		db.encryption = ring
+		return nil
+	}
+}
@@ -0,0 +1,218 @@
+package puredb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Page cursors are base64url encoded:
+//
+//	version   1 byte
+//	reverse   1 byte
+//	key       the raw key of the last record of the page
+//	mac       the first 16 bytes of the HMAC-SHA256 of the above, and of
+//	          the bucket name
+const (
+	cursorVersion = 1
+	cursorMACSize = 16
+)
+
+// cursorKeyName is where the key signing page cursors is kept, unless
+// given with WithCursorKey.
+const cursorKeyName = metaPrefix + "cursor_key"
+
+// WithCursorKey sets the key page cursors are signed with, so that they
+// can be verified by other databases sharing it. By default, each database
+// generates its own random key on first use and keeps it.
+func WithCursorKey(key []byte) PureDBOptionFn {
+	return func(db *PureDB) error {
+		if len(key) < 16 {
+			return fmt.Errorf("puredb: cursor key must be at least 16 bytes long")
+		}
+		db.cursorKey = append([]byte(nil), key...)
+		return nil
+	}
+}
+
+// getCursorKey returns the key page cursors are signed with, generating
+// and storing it the first time. Read-only databases without one use a
+// temporary key.
+func (db *PureDB) getCursorKey() ([]byte, error) {
+	db.cursorMu.Lock()
+	defer db.cursorMu.Unlock()
+
+	if db.cursorKey != nil {
+		return db.cursorKey, nil
+	}
+
+	err := db.view(func(txn StorageTxn) error {
+		key, err := txn.Get([]byte(cursorKeyName))
+		if err == nil {
+			db.cursorKey = append([]byte(nil), key...)
+		}
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil || db.cursorKey != nil {
+		return db.cursorKey, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if !db.readOnly {
+		err := db.update(func(txn StorageTxn) error {
+			// another process may have stored one meanwhile
+			stored, err := txn.Get([]byte(cursorKeyName))
+			if err == nil {
+				key = append(key[:0], stored...)
+				return nil
+			}
+			if err != ErrKeyNotFound {
+				return err
+			}
+			return txn.Set([]byte(cursorKeyName), key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	db.cursorKey = key
+	return key, nil
+}
+
+func (bucket *Bucket) cursorMAC(payload []byte) ([]byte, error) {
+	key, err := bucket.DB.getCursorKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(bucket.Name))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)[:cursorMACSize], nil
+}
+
+func (bucket *Bucket) encodeCursor(k_b []byte, reverse bool) (string, error) {
+	payload := []byte{cursorVersion, 0}
+	if reverse {
+		payload[1] = 1
+	}
+	payload = append(payload, k_b...)
+	mac, err := bucket.cursorMAC(payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(payload, mac...)), nil
+}
+
+func (bucket *Bucket) decodeCursor(cursor string, reverse bool) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) < 2+cursorMACSize || raw[0] != cursorVersion {
+		return nil, fmt.Errorf("puredb: invalid page cursor")
+	}
+	payload, mac := raw[:len(raw)-cursorMACSize], raw[len(raw)-cursorMACSize:]
+	expected, err := bucket.cursorMAC(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, fmt.Errorf("puredb: invalid page cursor")
+	}
+	if (payload[1] == 1) != reverse {
+		return nil, fmt.Errorf("puredb: page cursor was issued for the other direction")
+	}
+	return payload[2:], nil
+}
+
+// Page returns the keys and values of up to limit records, starting after
+// the ones returned by the call that produced cursor, or from the first
+// record (the last one, in reverse) if cursor is empty. It also returns
+// the cursor of the next page, empty when there are no more records.
+//
+// Cursors record the key of the last record returned and are signed, so
+// they can be handed to clients and back. Records added or deleted between
+// calls don't make pages skip or repeat the others.
+func (bucket *Bucket) Page(cursor string, limit int, reverse bool) ([]interface{}, []interface{}, string, error) {
+	db := bucket.DB
+	start := time.Now()
+
+	if limit <= 0 {
+		return nil, nil, "", fmt.Errorf("puredb: invalid page limit %d", limit)
+	}
+	var last []byte
+	if cursor != "" {
+		var err error
+		last, err = bucket.decodeCursor(cursor, reverse)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	var keys []interface{}
+	var values []interface{}
+	var next string
+
+	err := db.view(func(txn StorageTxn) error {
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+
+		opts := defaultIteratorOptions
+		opts.PrefetchSize = limit
+		opts.Reverse = reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		switch {
+		case reverse && last != nil:
+			seekBefore(it, bucket.recordKey(last))
+		case reverse:
+			seekBefore(it, prefixEnd(prefix))
+		case last != nil:
+			it.Seek(keyAfter(bucket.recordKey(last)))
+		default:
+			it.Seek(prefix)
+		}
+
+		var k_last []byte
+		for ; it.ValidForPrefix(prefix); it.Next() {
+			if len(keys) == limit {
+				// there is at least another record
+				var err error
+				next, err = bucket.encodeCursor(k_last, reverse)
+				return err
+			}
+
+			k_b := it.Key()[len(prefix):]
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			var k interface{}
+			var v interface{}
+			if err := bucket.UnmarshalKey(k_b, &k); err != nil {
+				return err
+			}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			values = append(values, v)
+			k_last = append(k_last[:0], k_b...)
+		}
+		return nil
+	})
+
+	db.logger.Debug("puredb: page", "bucket", bucket.Name, "reverse", reverse, "results", len(keys), "duration", time.Since(start), "err", err)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return keys, values, next, nil
+}
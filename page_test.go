@@ -0,0 +1,108 @@
+package puredb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPage(t *testing.T) {
+	forEachBackend(t, testPage)
+}
+
+func testPage(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("numbers", BucketOptsIntInt)
+	bucket := db.GetBucket("numbers")
+	for i := int64(0); i < 10; i++ {
+		bucket.Set(i*10, i)
+	}
+	// a key right after the end of the bucket prefix
+	db.update(func(txn StorageTxn) error {
+		return txn.Set([]byte("numbers_`"), []byte("x"))
+	})
+
+	pages := func(reverse bool, between func(page int)) []string {
+		var result []string
+		cursor := ""
+		for page := 0; ; page++ {
+			keys, _, next, err := bucket.Page(cursor, 3, reverse)
+			if err != nil {
+				t.Fatalf("can't get page - err:%v", err)
+			}
+			result = append(result, fmt.Sprint(keys))
+			if next == "" {
+				return result
+			}
+			cursor = next
+			if between != nil {
+				between(page)
+			}
+		}
+	}
+
+	if p := pages(false, nil); strings.Join(p, " ") != "[0 10 20] [30 40 50] [60 70 80] [90]" {
+		t.Fatalf("forward pages %v", p)
+	}
+	if p := pages(true, nil); strings.Join(p, " ") != "[90 80 70] [60 50 40] [30 20 10] [0]" {
+		t.Fatalf("reverse pages %v", p)
+	}
+
+	// records inserted and deleted between pages
+	p := pages(false, func(page int) {
+		if page == 0 {
+			bucket.Set(int64(5), int64(0))  // before the cursor
+			bucket.Set(int64(25), int64(0)) // right after it
+			bucket.Delete(int64(30))
+		}
+	})
+	if strings.Join(p, " ") != "[0 10 20] [25 40 50] [60 70 80] [90]" {
+		t.Fatalf("pages with concurrent writes %v", p)
+	}
+
+	// exactly a page
+	bucket.Delete(int64(5))
+	bucket.Delete(int64(25))
+	keys, _, next, _ := bucket.Page("", 9, false)
+	if len(keys) != 9 || next != "" {
+		t.Fatalf("full page returned %v and cursor %q", keys, next)
+	}
+
+	// tampering
+	_, _, next, _ = bucket.Page("", 2, false)
+	for _, cursor := range []string{next[:len(next)-1] + "A", "x" + next[1:], "!!"} {
+		if cursor == next {
+			continue
+		}
+		if _, _, _, err := bucket.Page(cursor, 2, false); err == nil {
+			t.Fatalf("tampered cursor %q was accepted", cursor)
+		}
+	}
+	if _, _, _, err := bucket.Page(next, 2, true); err == nil {
+		t.Fatal("cursor was accepted for the other direction")
+	}
+	db.AddBucket("others", BucketOptsIntInt)
+	if _, _, _, err := db.GetBucket("others").Page(next, 2, false); err == nil {
+		t.Fatal("cursor was accepted by another bucket")
+	}
+
+	// databases sharing the cursor key accept each other's cursors
+	key := []byte("0123456789abcdef")
+	db1, _ := Open("", WithInMemory(), WithCursorKey(key))
+	defer db1.Destroy()
+	db2, _ := Open("", WithInMemory(), WithCursorKey(key))
+	defer db2.Destroy()
+	for _, db := range []*PureDB{db1, db2} {
+		db.AddBucket("numbers", BucketOptsIntInt)
+		for i := int64(0); i < 4; i++ {
+			db.GetBucket("numbers").Set(i, i)
+		}
+	}
+	_, _, next, _ = db1.GetBucket("numbers").Page("", 2, false)
+	keys, _, _, err := db2.GetBucket("numbers").Page(next, 2, false)
+	if err != nil || fmt.Sprint(keys) != "[2 3]" {
+		t.Fatalf("cursor of a database sharing the key returned %v (err:%v)", keys, err)
+	}
+}
@@ -0,0 +1,396 @@
+package puredb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// histogramSize is the number of values sampled in index histograms.
+const histogramSize = 32
+
+// IndexStats describes the contents of an index, as of the last Analyze
+// plus the writes made since by this process.
+type IndexStats struct {
+	// Entries is the number of records in the index.
+	Entries int64
+	// Distinct is the number of distinct values indexed.
+	Distinct int64
+}
+
+// plannerStats are the statistics the query planner works with.
+type plannerStats struct {
+	Records int64                  `json:"records"`
+	Indexes map[string]*indexStats `json:"indexes"`
+}
+
+type indexStats struct {
+	IndexStats
+	// Histogram holds the encoded values at evenly spaced ranks of the
+	// index, to estimate how many records fall in a range.
+	Histogram [][]byte `json:"histogram"`
+}
+
+// setupStats loads the planner statistics, computing them if some index
+// has none.
+func (bucket *Bucket) setupStats() error {
+	db := bucket.DB
+
+	var meta bucketMeta
+	err := db.view(func(txn StorageTxn) error {
+		var err error
+		meta, _, err = bucket.loadMeta(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	stale := false
+	for _, index := range bucket.Opts.Indexes {
+		if meta.Stats == nil || meta.Stats.Indexes[index.Name] == nil {
+			stale = true
+		}
+	}
+	if stale && !db.readOnly {
+		return bucket.Analyze()
+	}
+
+	bucket.statsMu.Lock()
+	bucket.stats = meta.Stats
+	bucket.statsMu.Unlock()
+	return nil
+}
+
+// Analyze scans the bucket and its indexes to refresh the statistics the
+// query planner bases its decisions on. They are computed when an index is
+// built, and kept approximately up to date by the writes made through the
+// bucket, so Analyze only needs to be run after large changes, or when
+// the bucket is written by other processes.
+func (bucket *Bucket) Analyze() error {
+	db := bucket.DB
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	stats := &plannerStats{Indexes: make(map[string]*indexStats)}
+	err := db.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			stats.Records++
+		}
+		it.Close()
+
+		for _, index := range bucket.Opts.Indexes {
+			s, err := bucket.analyzeIndex(txn, index.Name)
+			if err != nil {
+				return err
+			}
+			stats.Indexes[index.Name] = s
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.update(func(txn StorageTxn) error {
+		meta, _, err := bucket.loadMeta(txn)
+		if err != nil {
+			return err
+		}
+		meta.Stats = stats
+		return bucket.saveMeta(txn, meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	bucket.statsMu.Lock()
+	bucket.stats = stats
+	bucket.statsMu.Unlock()
+
+	db.logger.Debug("puredb: analyze", "bucket", bucket.Name, "records", stats.Records)
+	return nil
+}
+
+// analyzeIndex counts the entries and distinct values of an index, then
+// samples its histogram in a second pass.
+func (bucket *Bucket) analyzeIndex(txn StorageTxn, name string) (*indexStats, error) {
+	s := &indexStats{}
+	prefix := bucket.indexPrefix(name)
+
+	opts := defaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var last []byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		value, err := indexEntryValue(it.Key()[len(prefix):])
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		s.Entries++
+		if last == nil || !bytes.Equal(last, value) {
+			s.Distinct++
+			last = append(last[:0], value...)
+		}
+	}
+	it.Close()
+
+	if s.Entries == 0 {
+		return s, nil
+	}
+	step := (s.Entries + histogramSize - 1) / histogramSize
+	it = txn.NewIterator(opts)
+	defer it.Close()
+	n := int64(0)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if n%step == 0 {
+			value, _ := indexEntryValue(it.Key()[len(prefix):])
+			s.Histogram = append(s.Histogram, append([]byte(nil), value...))
+		}
+		n++
+	}
+	return s, nil
+}
+
+// indexEntryValue returns the encoded value at the start of an index entry
+// key, stripped of the index prefix.
+func indexEntryValue(entry []byte) ([]byte, error) {
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("puredb: empty index entry")
+	}
+	n := 0
+	switch entry[0] {
+	case indexTagNil, indexTagFalse, indexTagTrue:
+		n = 1
+	case indexTagNumber:
+		n = 17
+	case indexTagTime:
+		n = 13
+	case indexTagString, indexTagBytes:
+		for i := 1; i+1 < len(entry); i++ {
+			if entry[i] == 0x00 {
+				if entry[i+1] == 0x01 {
+					n = i + 2
+					break
+				}
+				i++
+			}
+		}
+	}
+	if n == 0 || n > len(entry) {
+		return nil, fmt.Errorf("puredb: invalid index entry")
+	}
+	return entry[:n], nil
+}
+
+// countRecords adds delta to the number of records of the statistics once
+// txn is committed.
+func (bucket *Bucket) countRecords(txn StorageTxn, delta int64) {
+	afterCommit(txn, func() { bucket.addRecords(delta) })
+}
+
+func (bucket *Bucket) addRecords(delta int64) {
+	bucket.statsMu.Lock()
+	defer bucket.statsMu.Unlock()
+
+	if bucket.stats != nil {
+		bucket.stats.Records += delta
+	}
+}
+
+// countIndexEntries adds delta to the number of entries of the named index
+// once txn is committed.
+func (bucket *Bucket) countIndexEntries(txn StorageTxn, name string, delta int64) {
+	afterCommit(txn, func() { bucket.addIndexEntries(name, delta) })
+}
+
+func (bucket *Bucket) addIndexEntries(name string, delta int64) {
+	bucket.statsMu.Lock()
+	defer bucket.statsMu.Unlock()
+
+	if bucket.stats != nil && bucket.stats.Indexes[name] != nil {
+		s := bucket.stats.Indexes[name]
+		s.Entries += delta
+		if s.Entries < 0 {
+			s.Entries = 0
+		}
+	}
+}
+
+// IndexStats returns the statistics of the named index.
+func (bucket *Bucket) IndexStats(name string) (IndexStats, error) {
+	if _, err := bucket.index(name); err != nil {
+		return IndexStats{}, err
+	}
+
+	bucket.statsMu.Lock()
+	defer bucket.statsMu.Unlock()
+
+	if bucket.stats == nil || bucket.stats.Indexes[name] == nil {
+		return IndexStats{}, fmt.Errorf("puredb: index %q of bucket %q has not been analyzed", name, bucket.Name)
+	}
+	return bucket.stats.Indexes[name].IndexStats, nil
+}
+
+// QueryPlan describes how a query reads the records of its bucket.
+type QueryPlan struct {
+	// Index is the index the records are found through, or "" when the
+	// whole bucket is scanned.
+	Index string
+	// Field is the field of the index, and Filter the filters on it the
+	// index serves.
+	Field  string
+	Filter string
+	// Estimate is the estimated number of records read, out of Records.
+	Estimate int64
+	Records  int64
+	// Sorted is true when the records are read in the requested order, so
+	// that they don't have to be sorted.
+	Sorted bool
+
+	// start and end delimit the index entries to read.
+	start []byte
+	end   []byte
+}
+
+func (plan QueryPlan) String() string {
+	var s string
+	if plan.Index == "" {
+		s = fmt.Sprintf("full scan of %d records", plan.Records)
+	} else {
+		s = fmt.Sprintf("index %q on %s (%s): ~%d of %d records", plan.Index, plan.Field, plan.Filter, plan.Estimate, plan.Records)
+	}
+	if plan.Sorted {
+		s += ", sorted by the index"
+	}
+	return s
+}
+
+// Explain returns the plan the query would be run with.
+func (q *Query) Explain() (QueryPlan, error) {
+	if q.err != nil {
+		return QueryPlan{}, q.err
+	}
+	return q.plan(), nil
+}
+
+// plan picks the cheapest way to read the records of the query: through
+// the index that serves the most selective filters, or scanning the whole
+// bucket. Reading a record through an index costs about twice as much as
+// scanning it, as it takes a lookup.
+func (q *Query) plan() QueryPlan {
+	bucket := q.bucket
+
+	bucket.statsMu.Lock()
+	defer bucket.statsMu.Unlock()
+
+	best := QueryPlan{}
+	if bucket.stats == nil {
+		return best
+	}
+	best.Records = bucket.stats.Records
+	best.Estimate = best.Records
+	bestCost := best.Records
+
+	for i := range bucket.Opts.Indexes {
+		index := &bucket.Opts.Indexes[i]
+		s := bucket.stats.Indexes[index.Name]
+		if index.Field == "" || s == nil {
+			continue
+		}
+
+		// intersect the ranges of the filters on the field
+		var lo, hi []byte
+		var filters []string
+		eq := false
+		for _, filter := range q.filters {
+			if filter.field != index.Field || filter.op == "!=" || filter.enc[0] == indexTagNil {
+				continue
+			}
+			flo, fhi := filter.enc, prefixEnd(filter.enc)
+			switch filter.op {
+			case "<":
+				flo, fhi = filter.enc[:1], filter.enc
+			case "<=":
+				flo = filter.enc[:1]
+			case ">":
+				flo, fhi = prefixEnd(filter.enc), prefixEnd(filter.enc[:1])
+			case ">=":
+				fhi = prefixEnd(filter.enc[:1])
+			default:
+				eq = true
+			}
+			if lo == nil || bytes.Compare(flo, lo) > 0 {
+				lo = flo
+			}
+			if hi == nil || bytes.Compare(fhi, hi) < 0 {
+				hi = fhi
+			}
+			filters = append(filters, fmt.Sprintf("%s %v", filter.op, filter.value))
+		}
+		if lo == nil {
+			continue
+		}
+
+		var estimate int64
+		switch {
+		case bytes.Compare(lo, hi) >= 0:
+			estimate = 0
+		case eq && index.Unique:
+			estimate = 1
+		case eq && s.Distinct > 0:
+			estimate = (s.Entries + s.Distinct - 1) / s.Distinct
+		default:
+			estimate = s.estimateRange(lo, hi)
+		}
+		if estimate > s.Entries {
+			estimate = s.Entries
+		}
+		if 2*estimate >= bestCost {
+			continue
+		}
+		bestCost = 2 * estimate
+
+		prefix := bucket.indexPrefix(index.Name)
+		best = QueryPlan{
+			Index:    index.Name,
+			Field:    index.Field,
+			Filter:   strings.Join(filters, ", "),
+			Estimate: estimate,
+			Records:  best.Records,
+			Sorted:   q.ordered && !q.desc && q.order == index.Field,
+			start:    append(append([]byte(nil), prefix...), lo...),
+			end:      append(append([]byte(nil), prefix...), hi...),
+		}
+	}
+	return best
+}
+
+// estimateRange estimates the number of entries with values in [lo, hi)
+// from the histogram.
+func (s *indexStats) estimateRange(lo, hi []byte) int64 {
+	if len(s.Histogram) == 0 {
+		return 0
+	}
+	first := sort.Search(len(s.Histogram), func(i int) bool {
+		return bytes.Compare(s.Histogram[i], lo) >= 0
+	})
+	last := sort.Search(len(s.Histogram), func(i int) bool {
+		return bytes.Compare(s.Histogram[i], hi) >= 0
+	})
+	// each sample stands for Entries/len(Histogram) entries; count half a
+	// sample for the partial ones at the edges of the range
+	samples := float64(last-first) + 0.5
+	estimate := int64(samples * float64(s.Entries) / float64(len(s.Histogram)))
+	if estimate < 1 {
+		estimate = 1
+	}
+	return estimate
+}
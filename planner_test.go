@@ -0,0 +1,121 @@
+package puredb
+
+import (
+	"fmt"
+	"testing"
+)
+
+type plannerBook struct {
+	Id     int64  `puredb:"id,auto"`
+	ISBN   string `puredb:"index=isbn,unique"`
+	Author string `puredb:"index=author"`
+	Year   int    `puredb:"index=year"`
+	Title  string
+}
+
+func TestPlanner(t *testing.T) {
+	forEachBackend(t, testPlanner)
+}
+
+func testPlanner(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	books, err := NewModel[plannerBook](db, "books", BucketOpts{})
+	if err != nil {
+		t.Fatalf("can't create model - err:%v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		book := &plannerBook{
+			ISBN:   fmt.Sprintf("isbn-%04d", i),
+			Author: fmt.Sprintf("author %d", i%7),
+			Year:   1000 + i,
+			Title:  fmt.Sprintf("title %d", i%10),
+		}
+		if err := books.Save(book); err != nil {
+			t.Fatalf("can't save - err:%v", err)
+		}
+	}
+	bucket := books.Bucket
+
+	stats, err := bucket.IndexStats("author")
+	if err != nil || stats.Entries != 1000 {
+		t.Fatalf("unexpected author index stats %+v (err:%v)", stats, err)
+	}
+	if err := bucket.Analyze(); err != nil {
+		t.Fatalf("can't analyze - err:%v", err)
+	}
+	stats, _ = bucket.IndexStats("author")
+	if stats.Entries != 1000 || stats.Distinct != 7 {
+		t.Fatalf("unexpected author index stats after Analyze %+v", stats)
+	}
+
+	for _, c := range []struct {
+		query *Query
+		index string
+	}{
+		{bucket.Query().Where("ISBN", "=", "isbn-0042"), "isbn"},
+		{bucket.Query().Where("Year", "=", 1600), "year"},
+		{bucket.Query().Where("Year", ">=", 1980), "year"},
+		{bucket.Query().Where("Year", ">", 1100).Where("Year", "<", 1120), "year"},
+		{bucket.Query().Where("Author", "=", "author 1").Where("Year", ">=", 1500).Where("Year", "<=", 1510), "year"},
+		{bucket.Query().Where("Author", "=", "author 1").Where("Year", ">=", 1500), "author"},
+		{bucket.Query().Where("Year", ">=", 1100), ""},
+		{bucket.Query().Where("Year", "!=", 1100), ""},
+		{bucket.Query().Where("Title", "=", "title 1"), ""},
+	} {
+		plan, err := c.query.Explain()
+		if err != nil {
+			t.Fatalf("can't explain - err:%v", err)
+		}
+		if plan.Index != c.index {
+			t.Fatalf("query on %v was planned as %v, expected index %q", c.query.filters, plan, c.index)
+		}
+
+		// the plan doesn't change the results
+		keys, _, err := c.query.All()
+		if err != nil {
+			t.Fatalf("can't run query - err:%v", err)
+		}
+		var expected []interface{}
+		bucket.Iterate(func(bucket *Bucket, k interface{}, v interface{}) error {
+			if ok, _ := c.query.match(v); ok {
+				expected = append(expected, k)
+			}
+			return nil
+		})
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("query planned as %v returned %v, expected %v", plan, keys, expected)
+		}
+	}
+
+	// the index provides the order
+	q := bucket.Query().Where("Year", "<", 1010).OrderBy("Year").Offset(2).Limit(3)
+	plan, _ := q.Explain()
+	_, values, _ := q.All()
+	if !plan.Sorted || len(values) != 3 || values[0].(*plannerBook).Year != 1002 || values[2].(*plannerBook).Year != 1004 {
+		t.Fatalf("sorted query planned as %v returned %v", plan, values)
+	}
+
+	// statistics follow writes
+	for i := 0; i < 10; i++ {
+		books.Save(&plannerBook{ISBN: fmt.Sprintf("new-%d", i), Author: "author 0", Year: 2000})
+	}
+	books.Delete(int64(1))
+	stats, _ = bucket.IndexStats("year")
+	if stats.Entries != 1009 {
+		t.Fatalf("unexpected year index stats %+v after writes", stats)
+	}
+
+	// failed writes don't
+	if err := books.Save(&plannerBook{ISBN: "new-0", Year: 2001}); err != ErrDuplicate {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+	stats, _ = bucket.IndexStats("year")
+	bucket.statsMu.Lock()
+	records := bucket.stats.Records
+	bucket.statsMu.Unlock()
+	if stats.Entries != 1009 || records != 1009 {
+		t.Fatalf("unexpected stats %+v, %d records after a failed write", stats, records)
+	}
+}
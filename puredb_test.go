@@ -92,8 +92,32 @@ func addBook(t *testing.T, db *PureDB, book *Book) error {
 	return nil
 }
 
+// testBackends lists the options selecting each storage backend the test
+// suite runs against.
+var testBackends = []struct {
+	name    string
+	options []PureDBOptionFn
+}{
+	{"badger", nil},
+	{"memory", []PureDBOptionFn{WithInMemory()}},
+}
+
+// forEachBackend runs fn as a subtest for each storage backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, options ...PureDBOptionFn)) {
+	for _, backend := range testBackends {
+		options := backend.options
+		t.Run(backend.name, func(t *testing.T) {
+			fn(t, options...)
+		})
+	}
+}
+
 func TestPureDB(t *testing.T) {
-	db := OpenTestDB(t)
+	forEachBackend(t, testPureDB)
+}
+
+func testPureDB(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
 	defer db.Destroy()
 
 	id_book_opts := BucketOpts{}
@@ -220,3 +244,91 @@ func TempFileName(prefix, suffix string) string {
 
 	return filename + suffix
 }
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.msgs = append(l.msgs, msg) }
+
+func TestLogger(t *testing.T) {
+	forEachBackend(t, testLogger)
+}
+
+func testLogger(t *testing.T, options ...PureDBOptionFn) {
+	logger := &recordingLogger{}
+	db := OpenTestDB(t, append(options, WithLogger(logger))...)
+	defer db.Destroy()
+
+	db.AddBucket("counters", BucketOptsIntInt)
+	err := db.GetBucket("counters").Set(int64(1), int64(42))
+	if err != nil {
+		t.Fatalf("can't set - err:%v", err)
+	}
+
+	found := false
+	for _, msg := range logger.msgs {
+		if msg == "puredb: set" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a debug record for set, got %v", logger.msgs)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	invalid := map[string]PureDBOptionFn{
+		"value log file size": WithValueLogFileSize(1024),
+		"sequence bandwidth":  WithSequenceBandwidth(0),
+		"encryption key":      WithEncryptionKey([]byte("too short")),
+		"cursor key":          WithCursorKey([]byte("too short")),
+	}
+	for name, option := range invalid {
+		_, err := Open(TempFileName("puredb-", ".db"), option)
+		if err == nil {
+			t.Fatalf("expected an error for invalid %s option", name)
+		}
+	}
+
+	pathname := TempFileName("puredb-", ".db")
+	db, err := Open(pathname, WithSyncWrites(false), WithSequenceBandwidth(1), WithValueLogFileSize(16<<20))
+	if err != nil {
+		t.Fatal("can't open db", err)
+	}
+	db.AddBucket("counters", BucketOptsIntInt)
+	id, err := db.GetBucket("counters").Add(int64(42))
+	if err != nil {
+		t.Fatalf("can't add - err:%v", err)
+	}
+	db.Close()
+
+	db, err = Open(pathname, WithReadOnly())
+	if err != nil {
+		t.Fatal("can't reopen db read-only", err)
+	}
+	defer db.Destroy()
+	db.AddBucket("counters", BucketOptsIntInt)
+	v, err := db.GetBucket("counters").Get(id)
+	if err != nil || v.(int64) != 42 {
+		t.Fatalf("can't get back value from read-only db - v:%v err:%v", v, err)
+	}
+	_, err = db.GetBucket("counters").Add(int64(43))
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	// changing the format options needs no conversion
+	opts := BucketOptsIntInt
+	opts.Compression = CompressionGzip
+	if err := db.AddBucket("counters", opts); err != nil {
+		t.Fatalf("can't compress bucket of read-only db - err:%v", err)
+	}
+	v, err = db.GetBucket("counters").Get(id)
+	if err != nil || v.(int64) != 42 {
+		t.Fatalf("can't get back value from read-only db - v:%v err:%v", v, err)
+	}
+}
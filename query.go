@@ -0,0 +1,427 @@
+package puredb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Query selects records of a bucket by the fields of their values:
+//
+//	it, err := bucket.Query().
+//		Where("Year", ">=", 1600).
+//		Where("Available", "=", true).
+//		OrderBy("Price").
+//		Limit(20).
+//		Offset(40).
+//		Iter()
+//
+// Fields are looked up with reflection in structs, pointers to structs and
+// maps with string keys; nested fields are separated by dots, and the
+// empty field is the value itself. Missing map entries are nil.
+//
+// Values are compared like index values (see IndexFn): integers and floats
+// compare as numbers, strings and byte slices lexicographically, false
+// before true. The ordering operators only match values of the same kind
+// as the operand. Queries are built by chaining calls, and errors are
+// reported by Iter or All.
+type Query struct {
+	bucket  *Bucket
+	filters []queryFilter
+	order   string
+	ordered bool
+	desc    bool
+	limit   int
+	offset  int
+	err     error
+}
+
+type queryFilter struct {
+	field string
+	op    string
+	value interface{}
+	enc   []byte
+}
+
+// Query returns a new query over the records of the bucket.
+func (bucket *Bucket) Query() *Query {
+	return &Query{bucket: bucket, limit: -1}
+}
+
+// Where keeps only the records whose field compares to value according to
+// op, one of =, ==, !=, <, <=, > and >=.
+func (q *Query) Where(field string, op string, value interface{}) *Query {
+	switch op {
+	case "=", "==":
+		op = "="
+	case "!=", "<", "<=", ">", ">=":
+	default:
+		q.setErr(fmt.Errorf("puredb: unknown query operator %q", op))
+		return q
+	}
+	enc, err := encodeIndexValue(value)
+	if err != nil {
+		q.setErr(err)
+		return q
+	}
+	q.filters = append(q.filters, queryFilter{field: field, op: op, value: value, enc: enc})
+	return q
+}
+
+// OrderBy sorts the results by field, in ascending order. Records with
+// equal fields are returned in key order.
+func (q *Query) OrderBy(field string) *Query {
+	q.order, q.ordered, q.desc = field, true, false
+	return q
+}
+
+// OrderByDesc sorts the results by field, in descending order.
+func (q *Query) OrderByDesc(field string) *Query {
+	q.order, q.ordered, q.desc = field, true, true
+	return q
+}
+
+// Limit returns at most n results.
+func (q *Query) Limit(n int) *Query {
+	if n < 0 {
+		q.setErr(fmt.Errorf("puredb: invalid query limit %d", n))
+	}
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n results.
+func (q *Query) Offset(n int) *Query {
+	if n < 0 {
+		q.setErr(fmt.Errorf("puredb: invalid query offset %d", n))
+	}
+	q.offset = n
+	return q
+}
+
+func (q *Query) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// match reports whether value v satisfies all the filters of the query.
+func (q *Query) match(v interface{}) (bool, error) {
+	for _, filter := range q.filters {
+		fv, err := fieldValue(v, filter.field)
+		if err != nil {
+			return false, err
+		}
+		enc, err := encodeIndexValue(fv)
+		if err != nil {
+			return false, err
+		}
+		if !filter.match(enc) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (filter *queryFilter) match(enc []byte) bool {
+	cmp := bytes.Compare(enc, filter.enc)
+	switch filter.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	}
+	if enc[0] != filter.enc[0] {
+		// values of different kinds are not ordered
+		return false
+	}
+	switch filter.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// fieldValue returns the field of v at the dotted path.
+func fieldValue(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	rv := reflect.ValueOf(v)
+	for _, name := range strings.Split(path, ".") {
+		for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+			if rv.IsNil() {
+				return nil, nil
+			}
+			rv = rv.Elem()
+		}
+		switch rv.Kind() {
+		case reflect.Struct:
+			f := rv.FieldByName(name)
+			if !f.IsValid() {
+				return nil, fmt.Errorf("puredb: %v has no field %q", rv.Type(), name)
+			}
+			rv = f
+		case reflect.Map:
+			if rv.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("puredb: can't look up field %q in %v", name, rv.Type())
+			}
+			rv = rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+			if !rv.IsValid() {
+				return nil, nil
+			}
+		case reflect.Invalid:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("puredb: can't look up field %q in %v", name, rv.Type())
+		}
+	}
+	if !rv.CanInterface() {
+		return nil, fmt.Errorf("puredb: field %q is not exported", path)
+	}
+	return rv.Interface(), nil
+}
+
+// queryResult is a record matching a query.
+type queryResult struct {
+	k       interface{}
+	v       interface{}
+	sortKey []byte
+}
+
+// QueryIter iterates over the results of a Query. Unordered queries are
+// streamed from a read-only transaction, which is held until Close;
+// ordered ones are collected and sorted by Iter.
+type QueryIter struct {
+	query  *Query
+	plan   QueryPlan
+	txn    StorageTxn
+	it     StorageIterator
+	prefix []byte
+
+	results []queryResult
+	pos     int
+
+	skipped  int
+	returned int
+	current  queryResult
+	valid    bool
+	Err      error
+}
+
+// Iter runs the query, returning an iterator positioned on the first
+// result. It must be closed after use.
+//
+// The records are read through the plan returned by Explain.
+func (q *Query) Iter() (*QueryIter, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	db := q.bucket.DB
+	it := &QueryIter{
+		query:  q,
+		plan:   q.plan(),
+		txn:    db.storage.NewTransaction(false),
+		prefix: []byte(fmt.Sprintf("%s__", q.bucket.GetName())),
+	}
+	it.it = it.txn.NewIterator(defaultIteratorOptions)
+	if it.plan.Index != "" {
+		it.it.Seek(it.plan.start)
+	} else {
+		it.it.Seek(it.prefix)
+	}
+	db.logger.Debug("puredb: query", "bucket", q.bucket.Name, "plan", it.plan.String())
+
+	if q.ordered && !it.plan.Sorted {
+		if err := it.collect(); err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.it.Close()
+		it.it = nil
+		it.txn.Discard()
+		it.txn = nil
+	}
+
+	it.advance()
+	if it.Err != nil {
+		err := it.Err
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// All runs the query and returns the keys and values of all its results.
+func (q *Query) All() ([]interface{}, []interface{}, error) {
+	it, err := q.Iter()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+
+	var keys []interface{}
+	var values []interface{}
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.current.k)
+		values = append(values, it.current.v)
+	}
+	return keys, values, it.Err
+}
+
+// scan returns the next record matching the filters, read through the
+// plan.
+func (it *QueryIter) scan() (queryResult, bool, error) {
+	bucket := it.query.bucket
+	for ; it.it.Valid(); it.it.Next() {
+		var k_b, v_b []byte
+		var err error
+		if it.plan.Index == "" {
+			if !it.it.ValidForPrefix(it.prefix) {
+				break
+			}
+			k_b = it.it.Key()[len(it.prefix):]
+			v_b, err = it.it.Value()
+		} else {
+			if bytes.Compare(it.it.Key(), it.plan.end) >= 0 {
+				break
+			}
+			k_b, err = it.it.Value()
+			if err == nil {
+				k_b = append([]byte(nil), k_b...)
+				v_b, err = it.txn.Get(bucket.recordKey(k_b))
+			}
+		}
+		if err != nil {
+			return queryResult{}, false, err
+		}
+
+		var v interface{}
+		if err := bucket.decodeValue(it.txn, k_b, v_b, &v); err != nil {
+			return queryResult{}, false, err
+		}
+		ok, err := it.query.match(v)
+		if err != nil {
+			return queryResult{}, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		var k interface{}
+		if err := bucket.UnmarshalKey(k_b, &k); err != nil {
+			return queryResult{}, false, err
+		}
+		it.it.Next()
+		return queryResult{k: k, v: v}, true, nil
+	}
+	return queryResult{}, false, nil
+}
+
+// collect reads and sorts all the results of an ordered query.
+func (it *QueryIter) collect() error {
+	q := it.query
+	for {
+		r, ok, err := it.scan()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		fv, err := fieldValue(r.v, q.order)
+		if err != nil {
+			return err
+		}
+		r.sortKey, err = encodeIndexValue(fv)
+		if err != nil {
+			return err
+		}
+		it.results = append(it.results, r)
+	}
+
+	sort.SliceStable(it.results, func(i, j int) bool {
+		if q.desc {
+			return bytes.Compare(it.results[i].sortKey, it.results[j].sortKey) > 0
+		}
+		return bytes.Compare(it.results[i].sortKey, it.results[j].sortKey) < 0
+	})
+	return nil
+}
+
+// advance moves to the next result, applying offset and limit.
+func (it *QueryIter) advance() {
+	q := it.query
+	it.valid = false
+	for {
+		if q.limit >= 0 && it.returned >= q.limit {
+			return
+		}
+
+		var r queryResult
+		if it.results != nil {
+			if it.pos >= len(it.results) {
+				return
+			}
+			r = it.results[it.pos]
+			it.pos++
+		} else {
+			var ok bool
+			var err error
+			r, ok, err = it.scan()
+			if err != nil {
+				it.Err = err
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+
+		if it.skipped < q.offset {
+			it.skipped++
+			continue
+		}
+		it.returned++
+		it.current = r
+		it.valid = true
+		return
+	}
+}
+
+func (it *QueryIter) Valid() bool {
+	return it.valid
+}
+
+func (it *QueryIter) Next() {
+	it.advance()
+}
+
+// Get returns the key and value of the current result.
+func (it *QueryIter) Get(keyp *interface{}, valuep *interface{}) error {
+	if !it.valid {
+		return fmt.Errorf("puredb: query iterator is not positioned on a result")
+	}
+	*keyp = it.current.k
+	*valuep = it.current.v
+	return nil
+}
+
+func (it *QueryIter) Close() {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	if it.txn != nil {
+		it.txn.Discard()
+		it.txn = nil
+	}
+	it.valid = false
+}
@@ -0,0 +1,111 @@
+package puredb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func addQueryBooks(t *testing.T, db *PureDB) *Bucket {
+	db.AddBucket("query_books", BucketOptsIntBook)
+	bucket := db.GetBucket("query_books")
+	for i := 0; i < 100; i++ {
+		book := &Book{
+			Id:        int64(i),
+			Author:    fmt.Sprintf("author %d", i%7),
+			Title:     fmt.Sprintf("title %d", i),
+			Year:      1550 + i,
+			Available: i%2 == 0,
+			Price:     float64((i * 37) % 100),
+			Published: time.Date(1550+i, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := bucket.Set(book.Id, book); err != nil {
+			t.Fatalf("can't set - err:%v", err)
+		}
+	}
+	return bucket
+}
+
+func TestQuery(t *testing.T) {
+	forEachBackend(t, testQuery)
+}
+
+func testQuery(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	bucket := addQueryBooks(t, db)
+
+	// the reference result, computed by hand
+	var expected []Book
+	bucket.Iterate(func(bucket *Bucket, k interface{}, v interface{}) error {
+		book := v.(Book)
+		if book.Year >= 1600 && book.Available {
+			expected = append(expected, book)
+		}
+		return nil
+	})
+	for i := range expected {
+		for j := i + 1; j < len(expected); j++ {
+			if expected[j].Price < expected[i].Price {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+	}
+
+	it, err := bucket.Query().Where("Year", ">=", 1600).Where("Available", "=", true).OrderBy("Price").Limit(10).Offset(5).Iter()
+	if err != nil {
+		t.Fatalf("can't run query - err:%v", err)
+	}
+	n := 0
+	for ; it.Valid(); it.Next() {
+		var k, v interface{}
+		it.Get(&k, &v)
+		if v.(Book) != expected[5+n] {
+			t.Fatalf("result %d is %v, expected %v", n, v, expected[5+n])
+		}
+		n++
+	}
+	it.Close()
+	if n != 10 {
+		t.Fatalf("query returned %d results, expected 10", n)
+	}
+
+	// streamed, in key order
+	keys, _, err := bucket.Query().Where("Author", "=", "author 3").Where("Price", "<", 50).Offset(1).Limit(3).All()
+	if err != nil || fmt.Sprint(keys) != "[17 31 38]" {
+		t.Fatalf("query returned %v (err:%v)", keys, err)
+	}
+
+	keys, values, _ := bucket.Query().Where("Published", "<", time.Date(1553, 1, 1, 0, 0, 0, 0, time.UTC)).OrderByDesc("Title").All()
+	if fmt.Sprint(keys) != "[2 1 0]" || values[0].(Book).Title != "title 2" {
+		t.Fatalf("descending query returned %v", keys)
+	}
+
+	// values of different kinds are not ordered
+	if keys, _, _ := bucket.Query().Where("Year", "<", "z").All(); len(keys) != 0 {
+		t.Fatalf("query comparing numbers and strings returned %v", keys)
+	}
+
+	if _, err := bucket.Query().Where("Year", "~", 1600).Iter(); err == nil {
+		t.Fatal("expected an error for an unknown operator")
+	}
+	if _, _, err := bucket.Query().Where("Missing", "=", 1).All(); err == nil {
+		t.Fatal("expected an error for a missing struct field")
+	}
+
+	// maps, with nested fields
+	db.AddBucket("query_docs", BucketOptsIntJSON)
+	docs := db.GetBucket("query_docs")
+	for i := 0; i < 10; i++ {
+		doc := map[string]interface{}{"meta": map[string]interface{}{"rank": i % 3}}
+		if i != 5 {
+			doc["title"] = fmt.Sprintf("doc %d", i)
+		}
+		docs.Set(int64(i), doc)
+	}
+	keys, _, err = docs.Query().Where("meta.rank", "=", 1).Where("title", "!=", nil).All()
+	if err != nil || fmt.Sprint(keys) != "[1 4 7]" {
+		t.Fatalf("map query returned %v (err:%v)", keys, err)
+	}
+}
@@ -0,0 +1,285 @@
+package puredb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQueueEmpty is returned when popping from or peeking at an empty
+// queue.
+var ErrQueueEmpty = errors.New("puredb: queue is empty")
+
+// PriorityKey is the key of the elements of a PriorityQueue: their
+// priority, then the sequence number they were pushed with.
+type PriorityKey struct {
+	Priority int64
+	Seq      uint64
+}
+
+// defaultQueuePollInterval is how often PopWait looks for values pushed
+// through other queues by default.
+const defaultQueuePollInterval = time.Second
+
+// PriorityQueue stores values ordered by priority, and by insertion order
+// within equal priorities. Its elements are the records of a bucket, so
+// each push and pop is a transaction of its own.
+type PriorityQueue struct {
+	Bucket *Bucket
+
+	// PollInterval is how often PopWait checks the queue for values pushed
+	// through other PriorityQueue values, or by other processes, every
+	// second if zero.
+	PollInterval time.Duration
+
+	mu     sync.Mutex
+	pushed chan struct{}
+}
+
+// NewPriorityQueue adds a bucket named name for the elements of a priority
+// queue to the database. opts sets the value codecs, and the other options
+// not about keys.
+func NewPriorityQueue(db *PureDB, name string, opts BucketOpts) (*PriorityQueue, error) {
+	opts.MarshalKeyFn = func(v interface{}) ([]byte, error) {
+		k, ok := v.(PriorityKey)
+		if !ok {
+			return nil, fmt.Errorf("puredb: not a valid priority queue key: %v", v)
+		}
+		// flip the sign bit, so that negative priorities sort first
+		return append(u64tob(uint64(k.Priority)^1<<63), u64tob(k.Seq)...), nil
+	}
+	opts.UnmarshalKeyFn = func(data []byte, v *interface{}) error {
+		if len(data) != 16 {
+			return fmt.Errorf("puredb: invalid priority queue key length %d", len(data))
+		}
+		*v = PriorityKey{
+			Priority: int64(binary.BigEndian.Uint64(data) ^ 1<<63),
+			Seq:      binary.BigEndian.Uint64(data[8:]),
+		}
+		return nil
+	}
+	opts.IDGenerator = nil
+
+	if err := db.AddBucket(name, opts); err != nil {
+		return nil, err
+	}
+	return &PriorityQueue{Bucket: db.GetBucket(name), pushed: make(chan struct{})}, nil
+}
+
+// Push adds v to the queue with the given priority. Its sequence number is
+// taken in the transaction writing it, so that the values of a priority
+// are committed in the order of their sequence numbers: concurrent pushes
+// conflict instead, and are retried.
+func (q *PriorityQueue) Push(priority int64, v interface{}) error {
+	bucket := q.Bucket
+	db := bucket.DB
+	start := time.Now()
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	var seq uint64
+	var err error
+	for {
+		err = db.update(func(txn StorageTxn) error {
+			num, err := SequenceGenerator{GapFree: true}.NextID(bucket, txn)
+			if err != nil {
+				return err
+			}
+			seq = uint64(num.(int64))
+			k_b, err := bucket.MarshalKey(PriorityKey{Priority: priority, Seq: seq})
+			if err != nil {
+				return err
+			}
+			if err := bucket.reindex(txn, k_b, v, false); err != nil {
+				return err
+			}
+			v_b, err := bucket.encodeValue(txn, k_b, v)
+			if err != nil {
+				return err
+			}
+			if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
+				return err
+			}
+			return txn.Set(bucket.recordKey(k_b), v_b)
+		})
+		if err != ErrConflict {
+			break
+		}
+	}
+
+	db.logger.Debug("puredb: queue push", "bucket", bucket.Name, "priority", priority, "seq", seq, "duration", time.Since(start), "err", err)
+	if err != nil {
+		return err
+	}
+
+	// wake up the waiting pops
+	q.mu.Lock()
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+	q.mu.Unlock()
+	return nil
+}
+
+// PopMin removes and returns the oldest value with the lowest priority, or
+// ErrQueueEmpty.
+func (q *PriorityQueue) PopMin() (int64, interface{}, error) {
+	return q.pop(false, true)
+}
+
+// PopMax removes and returns the oldest value with the highest priority,
+// or ErrQueueEmpty.
+func (q *PriorityQueue) PopMax() (int64, interface{}, error) {
+	return q.pop(true, true)
+}
+
+// Peek returns the value PopMax would remove if max is true, the one
+// PopMin would remove otherwise, without removing it.
+func (q *PriorityQueue) Peek(max bool) (int64, interface{}, error) {
+	return q.pop(max, false)
+}
+
+// PopWait is like PopMax if max is true, like PopMin otherwise, but waits
+// for a value to be pushed while the queue is empty, until ctx is done.
+// The pushes made through q wake it up right away, the others are found
+// by checking the queue every PollInterval.
+func (q *PriorityQueue) PopWait(ctx context.Context, max bool) (int64, interface{}, error) {
+	interval := q.PollInterval
+	if interval <= 0 {
+		interval = defaultQueuePollInterval
+	}
+	for {
+		q.mu.Lock()
+		pushed := q.pushed
+		q.mu.Unlock()
+
+		priority, v, err := q.pop(max, true)
+		if err != ErrQueueEmpty {
+			return priority, v, err
+		}
+		select {
+		case <-pushed:
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// Len returns the number of values in the queue.
+func (q *PriorityQueue) Len() (int, error) {
+	return q.Bucket.Count()
+}
+
+// pop finds the oldest value with the lowest or highest priority, and
+// removes it if remove is true. Pops conflicting with concurrent ones are
+// retried.
+func (q *PriorityQueue) pop(max bool, remove bool) (int64, interface{}, error) {
+	bucket := q.Bucket
+	db := bucket.DB
+	start := time.Now()
+
+	if remove && db.readOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	var k PriorityKey
+	var v interface{}
+	fn := func(txn StorageTxn) error {
+		k_b, err := q.head(txn, max)
+		if err != nil {
+			return err
+		}
+
+		k_prefixed := bucket.recordKey(k_b)
+		v_b, err := txn.Get(k_prefixed)
+		if err != nil {
+			return err
+		}
+		var k_i interface{}
+		if err := bucket.UnmarshalKey(k_b, &k_i); err != nil {
+			return err
+		}
+		k = k_i.(PriorityKey)
+		if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+			return err
+		}
+		if !remove {
+			return nil
+		}
+
+		if err := bucket.reindex(txn, k_b, nil, true); err != nil {
+			return err
+		}
+		if err := bucket.dropPending(txn, k_b); err != nil {
+			return err
+		}
+		if err := bucket.trackCapacity(txn, k_b, nil); err != nil {
+			return err
+		}
+		return txn.Delete(k_prefixed)
+	}
+
+	var err error
+	for {
+		if remove {
+			err = db.update(fn)
+		} else {
+			err = db.view(fn)
+		}
+		if err != ErrConflict {
+			break
+		}
+	}
+
+	op := "peek"
+	if remove {
+		op = "pop"
+	}
+	db.logger.Debug("puredb: queue "+op, "bucket", bucket.Name, "max", max, "priority", k.Priority, "duration", time.Since(start), "err", err)
+	if err != nil {
+		return 0, nil, err
+	}
+	return k.Priority, v, nil
+}
+
+// head returns the key of the oldest element with the lowest or highest
+// priority.
+func (q *PriorityQueue) head(txn StorageTxn, max bool) ([]byte, error) {
+	prefix := []byte(fmt.Sprintf("%s__", q.Bucket.GetName()))
+
+	opts := defaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.PrefetchSize = 1
+	opts.Reverse = max
+	it := txn.NewIterator(opts)
+	if max {
+		seekBefore(it, prefixEnd(prefix))
+	} else {
+		it.Seek(prefix)
+	}
+	if !it.ValidForPrefix(prefix) {
+		it.Close()
+		return nil, ErrQueueEmpty
+	}
+	k_b := append([]byte(nil), it.Key()[len(prefix):]...)
+	it.Close()
+	if !max {
+		return k_b, nil
+	}
+
+	// the last key has the highest priority, but the most recent sequence
+	// number: look for the first one with the same priority
+	opts.Reverse = false
+	it = txn.NewIterator(opts)
+	defer it.Close()
+	it.Seek(append(prefix, k_b[:8]...))
+	if !it.ValidForPrefix(prefix) {
+		return nil, ErrQueueEmpty
+	}
+	return append([]byte(nil), it.Key()[len(prefix):]...), nil
+}
@@ -0,0 +1,110 @@
+package puredb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	forEachBackend(t, testPriorityQueue)
+}
+
+func testPriorityQueue(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	q, err := NewPriorityQueue(db, "jobs", BucketOptsIntInt)
+	if err != nil {
+		t.Fatalf("can't create queue - err:%v", err)
+	}
+	if _, _, err := q.PopMin(); err != ErrQueueEmpty {
+		t.Fatalf("popped from empty queue - err:%v", err)
+	}
+
+	push := func(priority int64, v int64) {
+		if err := q.Push(priority, v); err != nil {
+			t.Fatalf("can't push - err:%v", err)
+		}
+	}
+	push(5, 1)
+	push(-3, 2)
+	push(5, 3)
+	push(10, 4)
+	push(-3, 5)
+	push(10, 6)
+
+	if p, v, err := q.Peek(true); err != nil || p != 10 || v != int64(4) {
+		t.Fatalf("peeked %d: %v - err:%v", p, v, err)
+	}
+	if n, _ := q.Len(); n != 6 {
+		t.Fatalf("%d values after peek", n)
+	}
+
+	var popped []string
+	pop := func(max bool) {
+		pop := q.PopMin
+		if max {
+			pop = q.PopMax
+		}
+		p, v, err := pop()
+		if err != nil {
+			t.Fatalf("can't pop - err:%v", err)
+		}
+		popped = append(popped, fmt.Sprintf("%d:%v", p, v))
+	}
+	pop(true)
+	pop(false)
+	pop(true)
+	pop(false)
+	pop(true)
+	pop(true)
+	if s := fmt.Sprint(popped); s != "[10:4 -3:2 10:6 -3:5 5:1 5:3]" {
+		t.Fatalf("popped %s", s)
+	}
+
+	// blocking pops
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := q.PopWait(ctx, false); err != context.DeadlineExceeded {
+		t.Fatalf("pop from empty queue returned err:%v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(1, int64(7))
+	}()
+	if p, v, err := q.PopWait(context.Background(), false); err != nil || p != 1 || v != int64(7) {
+		t.Fatalf("waited for %d: %v - err:%v", p, v, err)
+	}
+
+	// pushes through other queues are found by polling
+	other := &PriorityQueue{Bucket: q.Bucket, pushed: make(chan struct{})}
+	q.PollInterval = 10 * time.Millisecond
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		other.Push(2, int64(8))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if p, v, err := q.PopWait(ctx, false); err != nil || p != 2 || v != int64(8) {
+		t.Fatalf("waited for %d: %v - err:%v", p, v, err)
+	}
+
+	// concurrent pushes are retried
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := q.Push(0, int64(i)); err != nil {
+				t.Errorf("can't push concurrently - err:%v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n, err := q.Len(); err != nil || n != 10 {
+		t.Fatalf("%d values after concurrent pushes - err:%v", n, err)
+	}
+}
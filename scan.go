@@ -0,0 +1,252 @@
+package puredb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// scanRangesPerWorker is the number of ranges a parallel scan splits the
+// bucket in for each worker, so that workers finishing early can take over
+// the ranges left.
+const scanRangesPerWorker = 4
+
+// scanBufferSize is the number of records each range of an ordered scan
+// decodes ahead of the callback.
+const scanBufferSize = 100
+
+// scanRecord is a record decoded by a parallel scan.
+type scanRecord struct {
+	k interface{}
+	v interface{}
+}
+
+// ParallelScan calls fn for every record of the bucket, reading and
+// decoding the records with workers goroutines. The bucket is split into
+// ranges of about the same number of keys, sampled in a first pass over the
+// keys only, and each range is read in its own read-only transaction, so
+// records written during the scan may be seen by some ranges and not by
+// others.
+//
+// fn is called concurrently by the workers, in no particular order; see
+// ParallelScanOrdered to get the records in key order. The scan stops at
+// the first error returned by fn, returning it unless it's Stop, or when
+// ctx is done. Workers may still be calling fn when another one stops the
+// scan.
+func (bucket *Bucket) ParallelScan(ctx context.Context, workers int, fn BucketCallback) error {
+	return bucket.parallelScan(ctx, workers, false, fn)
+}
+
+// ParallelScanOrdered is like ParallelScan, but calls fn from a single
+// goroutine, in key order, while the workers decode the records ahead.
+func (bucket *Bucket) ParallelScanOrdered(ctx context.Context, workers int, fn BucketCallback) error {
+	return bucket.parallelScan(ctx, workers, true, fn)
+}
+
+func (bucket *Bucket) parallelScan(ctx context.Context, workers int, ordered bool, fn BucketCallback) error {
+	if workers < 1 {
+		return fmt.Errorf("puredb: invalid number of workers %d", workers)
+	}
+
+	db := bucket.DB
+	start := time.Now()
+
+	ranges, err := bucket.scanRanges(ctx, workers*scanRangesPerWorker)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errOnce sync.Once
+	var scanErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			scanErr = err
+			cancel()
+		})
+	}
+
+	// outputs[i] receives the records of ranges[i] when ordered
+	var outputs []chan scanRecord
+	if ordered {
+		outputs = make([]chan scanRecord, len(ranges))
+		for i := range outputs {
+			outputs[i] = make(chan scanRecord, scanBufferSize)
+		}
+	}
+
+	// ranges are handed out in order, so that the ranges an ordered scan
+	// waits for are always being read
+	work := make(chan int)
+	go func() {
+		defer close(work)
+		for i := range ranges {
+			select {
+			case work <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				emit := func(k interface{}, v interface{}) error {
+					return fn(bucket, k, v)
+				}
+				if ordered {
+					out := outputs[i]
+					emit = func(k interface{}, v interface{}) error {
+						select {
+						case out <- scanRecord{k: k, v: v}:
+							return nil
+						case <-ctx.Done():
+							return ctx.Err()
+						}
+					}
+				}
+				if err := bucket.scanRange(ctx, ranges[i], emit); err != nil {
+					fail(err)
+				}
+				if ordered {
+					// after fail, so that the merge doesn't move on to
+					// the next range
+					close(outputs[i])
+				}
+			}
+		}()
+	}
+
+	if ordered {
+	merge:
+		for _, out := range outputs {
+			for r := range out {
+				if ctx.Err() != nil {
+					break merge
+				}
+				if err := fn(bucket, r.k, r.v); err != nil {
+					fail(err)
+					break merge
+				}
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	wg.Wait()
+
+	if scanErr == nil {
+		// the parent context may be done without any worker noticing
+		scanErr = ctx.Err()
+	}
+	if scanErr == Stop {
+		scanErr = nil
+	}
+
+	db.logger.Debug("puredb: parallel scan", "bucket", bucket.Name, "workers", workers, "ranges", len(ranges), "ordered", ordered, "duration", time.Since(start), "err", scanErr)
+	return scanErr
+}
+
+// scanRange is a range of record keys, from start included to end
+// excluded, or to the end of the bucket when end is nil.
+type scanRange struct {
+	start []byte
+	end   []byte
+}
+
+// scanRanges splits the bucket in at most n ranges of about the same
+// number of keys. It keeps every step-th key as a range boundary, doubling
+// the step and dropping every other boundary each time there are more than
+// 2n of them, so that the boundaries stay evenly spaced in a single pass.
+func (bucket *Bucket) scanRanges(ctx context.Context, n int) ([]scanRange, error) {
+	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+
+	var boundaries [][]byte
+	err := bucket.DB.view(func(txn StorageTxn) error {
+		opts := defaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		step := 1
+		i := 0
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if i%step == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				boundaries = append(boundaries, append([]byte(nil), it.Key()...))
+				if len(boundaries) > 2*n {
+					kept := boundaries[:0]
+					for j := 0; j < len(boundaries); j += 2 {
+						kept = append(kept, boundaries[j])
+					}
+					boundaries = kept
+					step *= 2
+				}
+			}
+			i++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := []scanRange{{start: prefix}}
+	every := (len(boundaries) + n - 1) / n
+	for j := every; every > 0 && j < len(boundaries); j += every {
+		ranges[len(ranges)-1].end = boundaries[j]
+		ranges = append(ranges, scanRange{start: boundaries[j]})
+	}
+	return ranges, nil
+}
+
+// scanRange decodes the records in r, passing them to fn.
+func (bucket *Bucket) scanRange(ctx context.Context, r scanRange, fn func(k interface{}, v interface{}) error) error {
+	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+
+	return bucket.DB.view(func(txn StorageTxn) error {
+		it := txn.NewIterator(defaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(r.start); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			k_prefixed := it.Key()
+			if r.end != nil && bytes.Compare(k_prefixed, r.end) >= 0 {
+				break
+			}
+			v_b, err := it.Value()
+			if err != nil {
+				return err
+			}
+			// the records can outlive the transaction
+			k_b := append([]byte(nil), k_prefixed[len(prefix):]...)
+			v_b = append([]byte(nil), v_b...)
+
+			var k interface{}
+			var v interface{}
+			if err := bucket.UnmarshalKey(k_b, &k); err != nil {
+				return err
+			}
+			if err := bucket.decodeValue(txn, k_b, v_b, &v); err != nil {
+				return err
+			}
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+package puredb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParallelScan(t *testing.T) {
+	forEachBackend(t, testParallelScan)
+}
+
+func testParallelScan(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	opts := BucketOptsIntInt
+	opts.Compression = CompressionGzip
+	db.AddBucket("numbers", opts)
+	bucket := db.GetBucket("numbers")
+	for i := int64(0); i < 500; i++ {
+		bucket.Set(i, i*i)
+	}
+	// a key right after the end of the bucket prefix
+	db.update(func(txn StorageTxn) error {
+		return txn.Set([]byte("numbers_`"), []byte("x"))
+	})
+
+	var mu sync.Mutex
+	seen := make(map[int64]int64)
+	err := bucket.ParallelScan(context.Background(), 4, func(bucket *Bucket, k interface{}, v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[k.(int64)] = v.(int64)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't scan - err:%v", err)
+	}
+	if len(seen) != 500 {
+		t.Fatalf("scanned %d records", len(seen))
+	}
+	for k, v := range seen {
+		if v != k*k {
+			t.Fatalf("record %d is %d", k, v)
+		}
+	}
+
+	var keys []int64
+	err = bucket.ParallelScanOrdered(context.Background(), 3, func(bucket *Bucket, k interface{}, v interface{}) error {
+		keys = append(keys, k.(int64))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't scan - err:%v", err)
+	}
+	if len(keys) != 500 {
+		t.Fatalf("scanned %d records in order", len(keys))
+	}
+	for i, k := range keys {
+		if k != int64(i) {
+			t.Fatalf("record %d has key %d", i, k)
+		}
+	}
+
+	// errors stop the scan
+	stop := fmt.Errorf("stop")
+	n := 0
+	err = bucket.ParallelScanOrdered(context.Background(), 2, func(bucket *Bucket, k interface{}, v interface{}) error {
+		n++
+		if k.(int64) == 100 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 101 {
+		t.Fatalf("scan stopped after %d records with err:%v", n, err)
+	}
+	err = bucket.ParallelScan(context.Background(), 2, func(bucket *Bucket, k interface{}, v interface{}) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("scan returned err:%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bucket.ParallelScan(ctx, 2, func(*Bucket, interface{}, interface{}) error { return nil }); err != context.Canceled {
+		t.Fatalf("canceled scan returned err:%v", err)
+	}
+	if err := bucket.ParallelScan(context.Background(), 0, nil); err == nil {
+		t.Fatalf("scan with no workers didn't fail")
+	}
+
+	db.AddBucket("empty", BucketOptsIntInt)
+	err = db.GetBucket("empty").ParallelScanOrdered(context.Background(), 2, func(*Bucket, interface{}, interface{}) error {
+		return fmt.Errorf("record in empty bucket")
+	})
+	if err != nil {
+		t.Fatalf("can't scan empty bucket - err:%v", err)
+	}
+}
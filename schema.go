@@ -0,0 +1,347 @@
+package puredb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// UpgradeFn converts a marshaled value from one schema version to the
+// next.
+type UpgradeFn func(data []byte) ([]byte, error)
+
+// defaultMigrationBatchSize is the number of values rewritten in each
+// transaction by Migrate.
+const defaultMigrationBatchSize = 1000
+
+// metaPrefix starts the keys PureDB keeps its own records under. Bucket
+// keys start with the bucket name, so they never collide with it.
+const metaPrefix = "\x00puredb__"
+
+// bucketMeta is the record PureDB keeps about each bucket.
+type bucketMeta struct {
+	// Framed tells whether all the values of the bucket are stored in
+	// envelopes. Otherwise, those before the frame boundary are, see
+	// frameKey.
+	Framed bool `json:"framed"`
+
+	// MigrateVersion is the schema version of the last Migrate, and
+	// MigrateNext, while it's running, the key it has to resume from.
+	MigrateVersion uint32 `json:"migrate_version,omitempty"`
+	MigrateNext    []byte `json:"migrate_next,omitempty"`
+
+	// Indexes are the names of the indexes built.
+	Indexes []string `json:"indexes,omitempty"`
+	// Stats are the statistics of the last Analyze.
+	Stats *plannerStats `json:"stats,omitempty"`
+}
+
+func (bucket *Bucket) metaKey() []byte {
+	return []byte(metaPrefix + "bucket__" + bucket.Name)
+}
+
+func (bucket *Bucket) loadMeta(txn StorageTxn) (bucketMeta, bool, error) {
+	var meta bucketMeta
+	v_b, err := txn.Get(bucket.metaKey())
+	if err == ErrKeyNotFound {
+		return meta, false, nil
+	}
+	if err != nil {
+		return meta, false, err
+	}
+	err = json.Unmarshal(v_b, &meta)
+	return meta, err == nil, err
+}
+
+func (bucket *Bucket) saveMeta(txn StorageTxn, meta bucketMeta) error {
+	v_b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return txn.Set(bucket.metaKey(), v_b)
+}
+
+// setupFormat finds out whether all the values of the bucket are stored
+// in envelopes, as they are in new buckets. The values of buckets set up
+// before there were envelopes are left as they are, for Migrate.
+func (bucket *Bucket) setupFormat() error {
+	db := bucket.DB
+
+	fn := func(txn StorageTxn) error {
+		meta, found, err := bucket.loadMeta(txn)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// a new bucket, or one set up before PureDB kept records,
+			// whose values have no envelopes
+			prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+			opts := defaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.PrefetchSize = 1
+			it := txn.NewIterator(opts)
+			it.Seek(prefix)
+			meta.Framed = !it.ValidForPrefix(prefix)
+			it.Close()
+		}
+		bucket.framedAll = meta.Framed
+		if found || db.readOnly {
+			return nil
+		}
+		return bucket.saveMeta(txn, meta)
+	}
+	var err error
+	if db.readOnly {
+		err = db.view(fn)
+	} else {
+		err = db.update(fn)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !bucket.framedAll {
+		db.logger.Info("puredb: bucket values stored without headers, Migrate adds them", "bucket", bucket.Name)
+	}
+	return nil
+}
+
+// checkUpgrades checks there is an upgrade function for each version
+// before SchemaVersion.
+func (bucket *Bucket) checkUpgrades() error {
+	for version := uint32(1); version < bucket.Opts.SchemaVersion; version++ {
+		if bucket.Opts.Upgrades[version] == nil {
+			return fmt.Errorf("puredb: bucket %q has no upgrade from schema version %d", bucket.Name, version)
+		}
+	}
+	return nil
+}
+
+// upgradeValue brings marshaled data from the given schema version to the
+// current one.
+func (bucket *Bucket) upgradeValue(data []byte, version uint32) ([]byte, error) {
+	if bucket.Opts.SchemaVersion == 0 {
+		return data, nil
+	}
+	if version > bucket.Opts.SchemaVersion {
+		return nil, fmt.Errorf("puredb: value has schema version %d, newer than %d of bucket %q", version, bucket.Opts.SchemaVersion, bucket.Name)
+	}
+	for ; version < bucket.Opts.SchemaVersion; version++ {
+		var err error
+		data, err = bucket.Opts.Upgrades[version](data)
+		if err != nil {
+			return nil, fmt.Errorf("puredb: can't upgrade value from schema version %d: %v", version, err)
+		}
+	}
+	return data, nil
+}
+
+// Migrate converts to the current format the values of the bucket,
+// returning how many it rewrote: it stores in envelopes the values stored
+// without one, before there were envelopes, and upgrades to the current
+// SchemaVersion the values stored with an older one. Values are otherwise
+// upgraded only in memory, every time they are read.
+//
+// Migrate works online, in batches each committed in its own transaction
+// along with a checkpoint, so that an interrupted migration resumes where
+// it stopped. Until all the values are in envelopes, writes to the bucket
+// conflict with the batches storing them in envelopes.
+func (bucket *Bucket) Migrate(ctx context.Context) (int, error) {
+	db := bucket.DB
+	target := bucket.Opts.SchemaVersion
+
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	framed, err := bucket.migrateFormat(ctx)
+	if err != nil || target == 0 {
+		db.logger.Info("puredb: migrate", "bucket", bucket.Name, "framed", framed, "err", err)
+		return framed, err
+	}
+
+	var start []byte
+	err = db.view(func(txn StorageTxn) error {
+		meta, _, err := bucket.loadMeta(txn)
+		if meta.MigrateVersion == target {
+			start = meta.MigrateNext
+		}
+		return err
+	})
+	if err != nil {
+		return framed, err
+	}
+	if start != nil {
+		db.logger.Info("puredb: resuming migration", "bucket", bucket.Name, "version", target)
+	}
+
+	migrated, err := bucket.rewriteValues(ctx, start, defaultMigrationBatchSize, func(txn StorageTxn, k_b []byte, v_b []byte) ([]byte, error) {
+		data, version, err := bucket.openValue(txn, k_b, v_b)
+		if err != nil || version == target {
+			return nil, err
+		}
+		data, err = bucket.upgradeValue(data, version)
+		if err != nil {
+			return nil, err
+		}
+		return bucket.sealValue(k_b, data, target)
+	}, func(txn StorageTxn, next []byte) error {
+		meta, _, err := bucket.loadMeta(txn)
+		if err != nil {
+			return err
+		}
+		meta.MigrateVersion = target
+		meta.MigrateNext = next
+		return bucket.saveMeta(txn, meta)
+	})
+
+	db.logger.Info("puredb: migrate", "bucket", bucket.Name, "version", target, "framed", framed, "migrated", migrated, "err", err)
+	return framed + migrated, err
+}
+
+// migrateFormat stores in envelopes, upgraded to the current schema
+// version, the values of the bucket after its frame boundary, moving the
+// boundary along with each batch. It returns how many values it stored.
+func (bucket *Bucket) migrateFormat(ctx context.Context) (int, error) {
+	if bucket.framedAll {
+		return 0, nil
+	}
+
+	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+	end := prefixEnd(prefix)
+	var start []byte
+	err := bucket.DB.view(func(txn StorageTxn) error {
+		boundary, err := txn.Get(bucket.frameKey())
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		start = append([]byte(nil), boundary...)
+		return err
+	})
+	if err != nil || bytes.Equal(start, end) {
+		return 0, err
+	}
+
+	return bucket.rewriteValues(ctx, start, defaultMigrationBatchSize, func(txn StorageTxn, k_b []byte, v_b []byte) ([]byte, error) {
+		data, err := bucket.upgradeValue(v_b, 1)
+		if err != nil {
+			return nil, err
+		}
+		return bucket.sealValue(k_b, data, bucket.Opts.SchemaVersion)
+	}, func(txn StorageTxn, next []byte) error {
+		if next != nil {
+			return txn.Set(bucket.frameKey(), next)
+		}
+		meta, _, err := bucket.loadMeta(txn)
+		if err != nil {
+			return err
+		}
+		meta.Framed = true
+		if err := bucket.saveMeta(txn, meta); err != nil {
+			return err
+		}
+		return txn.Set(bucket.frameKey(), prefixEnd(prefix))
+	})
+}
+
+// rewriteValues walks the values of the bucket from the prefixed key
+// start (from the first one, if nil), replacing each value with what fn
+// returns for it, unless that's nil. See walkValues.
+//
+// It returns the number of values replaced.
+func (bucket *Bucket) rewriteValues(ctx context.Context, start []byte, batchSize int, fn func(txn StorageTxn, k_b []byte, v_b []byte) ([]byte, error), checkpoint func(txn StorageTxn, next []byte) error) (int, error) {
+	return bucket.walkValues(ctx, start, batchSize, func(txn StorageTxn, k_b []byte, v_b []byte) (bool, error) {
+		v_b, err := fn(txn, k_b, v_b)
+		if err != nil || v_b == nil {
+			return false, err
+		}
+		if err := bucket.trackCapacity(txn, k_b, v_b); err != nil {
+			return false, err
+		}
+		return true, txn.Set(bucket.recordKey(k_b), v_b)
+	}, checkpoint)
+}
+
+// walkValues calls fn for each value of the bucket from the prefixed key
+// start (from the first one, if nil). It works in batches of batchSize
+// values, each in its own read-write transaction, in which checkpoint, if
+// not nil, is called with the key to resume from, nil after the last
+// batch. Batches conflicting with concurrent writes are retried.
+//
+// It returns the number of values for which fn returned true.
+func (bucket *Bucket) walkValues(ctx context.Context, start []byte, batchSize int, fn func(txn StorageTxn, k_b []byte, v_b []byte) (bool, error), checkpoint func(txn StorageTxn, next []byte) error) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("puredb: invalid batch size %d", batchSize)
+	}
+
+	db := bucket.DB
+	prefix := []byte(fmt.Sprintf("%s__", bucket.GetName()))
+	if start == nil {
+		start = prefix
+	}
+	walked := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return walked, err
+		}
+
+		var next []byte
+		count := 0
+		err := db.update(func(txn StorageTxn) error {
+			next = nil
+			count = 0
+
+			type entry struct {
+				k_b []byte
+				v_b []byte
+			}
+			var batch []entry
+
+			// collect the batch first: the iterator must be closed
+			// before writing
+			it := txn.NewIterator(defaultIteratorOptions)
+			for it.Seek(start); it.ValidForPrefix(prefix) && len(batch) < batchSize; it.Next() {
+				v_b, err := it.Value()
+				if err != nil {
+					it.Close()
+					return err
+				}
+				k_prefixed := it.Key()
+				next = keyAfter(k_prefixed)
+				batch = append(batch, entry{append([]byte(nil), k_prefixed[len(prefix):]...), append([]byte(nil), v_b...)})
+			}
+			if len(batch) < batchSize {
+				next = nil
+			}
+			it.Close()
+
+			for _, e := range batch {
+				done, err := fn(txn, e.k_b, e.v_b)
+				if err != nil {
+					return err
+				}
+				if done {
+					count++
+				}
+			}
+			if checkpoint != nil {
+				return checkpoint(txn, next)
+			}
+			return nil
+		})
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return walked, err
+		}
+
+		walked += count
+		if next == nil {
+			return walked, nil
+		}
+		start = next
+	}
+}
@@ -0,0 +1,111 @@
+package puredb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestSchemaVersions(t *testing.T) {
+	forEachBackend(t, testSchemaVersions)
+}
+
+func testSchemaVersions(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	const n = 2500
+
+	// version 1: {"name": ...}
+	db.AddBucket("books", BucketOptsIntJSON)
+	bucket := db.GetBucket("books")
+	for k := int64(1); k <= n; k++ {
+		if err := bucket.Set(k, map[string]interface{}{"name": fmt.Sprintf("book %d", k)}); err != nil {
+			t.Fatalf("can't set - err:%v", err)
+		}
+	}
+
+	renameField := func(from, to string) UpgradeFn {
+		return func(data []byte) ([]byte, error) {
+			var m map[string]interface{}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, err
+			}
+			m[to] = m[from]
+			delete(m, from)
+			return json.Marshal(m)
+		}
+	}
+
+	// version 2: "name" renamed to "title"
+	opts := BucketOptsIntJSON
+	opts.SchemaVersion = 3
+	if err := db.AddBucket("books", opts); err == nil {
+		t.Fatal("expected an error for missing upgrade functions")
+	}
+	opts.SchemaVersion = 2
+	opts.Upgrades = map[uint32]UpgradeFn{1: renameField("name", "title")}
+	if err := db.AddBucket("books", opts); err != nil {
+		t.Fatalf("can't add bucket with schema version - err:%v", err)
+	}
+	bucket = db.GetBucket("books")
+	v, err := bucket.Get(int64(7))
+	if err != nil || v.(map[string]interface{})["title"] != "book 7" {
+		t.Fatalf("value not upgraded on read - v:%v err:%v", v, err)
+	}
+	bucket.Set(int64(n+1), map[string]interface{}{"title": "new book"})
+
+	// version 3: "title" renamed to "label", with a migration interrupted
+	// in its second batch
+	calls := 0
+	interrupt := true
+	opts.SchemaVersion = 3
+	opts.Upgrades = map[uint32]UpgradeFn{
+		1: renameField("name", "title"),
+		2: func(data []byte) ([]byte, error) {
+			calls++
+			if interrupt && calls == defaultMigrationBatchSize+200 {
+				return nil, fmt.Errorf("interrupted")
+			}
+			return renameField("title", "label")(data)
+		},
+	}
+	db.AddBucket("books", opts)
+	bucket = db.GetBucket("books")
+	if _, err := bucket.Migrate(context.Background()); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	var meta bucketMeta
+	db.view(func(txn StorageTxn) error {
+		meta, _, err = bucket.loadMeta(txn)
+		return err
+	})
+	if meta.MigrateVersion != 3 || string(meta.MigrateNext) != string(keyAfter([]byte("books__"+string(i64tob(defaultMigrationBatchSize))))) {
+		t.Fatalf("unexpected migration checkpoint %+v", meta)
+	}
+
+	calls = 0
+	interrupt = false
+	migrated, err := bucket.Migrate(context.Background())
+	if err != nil || migrated != n+1-defaultMigrationBatchSize || calls != migrated {
+		t.Fatalf("resumed migration upgraded %v values with %v calls, expected %v (err:%v)", migrated, calls, n+1-defaultMigrationBatchSize, err)
+	}
+	for _, k := range []int64{1, 1500, n + 1} {
+		v, err := bucket.Get(k)
+		if err != nil || v.(map[string]interface{})["label"] == nil {
+			t.Fatalf("value %v not migrated - v:%v err:%v", k, v, err)
+		}
+	}
+	if migrated, _ := bucket.Migrate(context.Background()); migrated != 0 {
+		t.Fatalf("second migration upgraded %v values", migrated)
+	}
+
+	// dropping versioning leaves the values readable
+	db.AddBucket("books", BucketOptsIntJSON)
+	bucket = db.GetBucket("books")
+	v, err = bucket.Get(int64(n + 1))
+	if err != nil || v.(map[string]interface{})["label"] != "new book" {
+		t.Fatalf("can't get value after dropping versions - v:%v err:%v", v, err)
+	}
+}
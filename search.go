@@ -0,0 +1,200 @@
+package puredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stop can be returned by callbacks and predicates to end a scan early
+// without failing it: Iterate, IterateKeys, Search, ParallelScan and
+// ParallelScanOrdered return nil, and searches return what they found so
+// far, including the current record if the predicate returned true along
+// with Stop.
+var Stop = errors.New("puredb: stop")
+
+// SearchIter streams the records matching a search, see SearchStream.
+type SearchIter struct {
+	bucket  *Bucket
+	ctx     context.Context
+	v       interface{}
+	cmpFn   BucketPredicate
+	reverse bool
+	limit   int
+
+	txn    StorageTxn
+	it     StorageIterator
+	prefix []byte
+
+	started  bool
+	last     bool
+	done     bool
+	scanned  int
+	returned int
+	start    time.Time
+
+	key   interface{}
+	value interface{}
+	err   error
+}
+
+// SearchStream returns an iterator over the records for which cmpFn
+// returns true, or whose value equals v if cmpFn is nil, like SearchAll,
+// but reading the bucket only as the records are consumed:
+//
+//	it := bucket.SearchStream(ctx, nil, available, false).Limit(10)
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// cmpFn can return Stop to end the search, after the current record if it
+// matches. The records are read in a read-only transaction, held until the
+// end of the search or Close.
+func (bucket *Bucket) SearchStream(ctx context.Context, v interface{}, cmpFn BucketPredicate, reverse bool) *SearchIter {
+	return &SearchIter{
+		bucket:  bucket,
+		ctx:     ctx,
+		v:       v,
+		cmpFn:   cmpFn,
+		reverse: reverse,
+		limit:   -1,
+	}
+}
+
+// Limit ends the search after n records. It must be called before Next.
+func (it *SearchIter) Limit(n int) *SearchIter {
+	if it.started {
+		it.err = fmt.Errorf("puredb: search limit set after the search started")
+	} else if n < 0 {
+		it.err = fmt.Errorf("puredb: invalid search limit %d", n)
+	}
+	it.limit = n
+	return it
+}
+
+// Next moves to the next matching record, returning false at the end of
+// the search or on error.
+func (it *SearchIter) Next() bool {
+	it.key, it.value = nil, nil
+	if it.err != nil || it.last || it.limit == 0 {
+		it.finish()
+		return false
+	}
+
+	bucket := it.bucket
+	if !it.started {
+		it.started = true
+		it.start = time.Now()
+
+		opts := defaultIteratorOptions
+		opts.PrefetchSize = 10
+		opts.Reverse = it.reverse
+		it.txn = bucket.DB.storage.NewTransaction(false)
+		it.it = it.txn.NewIterator(opts)
+		it.prefix = []byte(fmt.Sprintf("%s__", bucket.GetName()))
+		if it.reverse {
+			seekBefore(it.it, prefixEnd(it.prefix))
+		} else {
+			it.it.Seek(it.prefix)
+		}
+	} else if it.it != nil {
+		it.it.Next()
+	}
+
+	for ; it.it != nil && it.it.ValidForPrefix(it.prefix); it.it.Next() {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			break
+		}
+		it.scanned++
+
+		k_prefixed := it.it.Key()
+		v_b, err := it.it.Value()
+		if err != nil {
+			it.err = err
+			break
+		}
+		k_b := k_prefixed[len(it.prefix):]
+
+		var k_i interface{}
+		var v_i interface{}
+		if err := bucket.UnmarshalKey(k_b, &k_i); err != nil {
+			it.err = err
+			break
+		}
+		if err := bucket.decodeValue(it.txn, k_b, v_b, &v_i); err != nil {
+			it.err = err
+			break
+		}
+
+		found := it.v == v_i
+		if it.cmpFn != nil {
+			found, err = it.cmpFn(bucket, k_i, v_i)
+			if err == Stop {
+				it.last = true
+			} else if err != nil {
+				bucket.DB.logger.Debug("puredb: search stream: error in cmpFn", "bucket", bucket.Name, "key", k_i, "err", err)
+				it.err = err
+				break
+			}
+		}
+		if found {
+			it.key, it.value = k_i, v_i
+			it.returned++
+			if it.limit >= 0 && it.returned >= it.limit {
+				it.last = true
+			}
+			return true
+		}
+		if it.last {
+			break
+		}
+	}
+
+	it.finish()
+	return false
+}
+
+// Key returns the key of the current record.
+func (it *SearchIter) Key() interface{} {
+	return it.key
+}
+
+// Value returns the value of the current record.
+func (it *SearchIter) Value() interface{} {
+	return it.value
+}
+
+// Err returns the error that ended the search, if any.
+func (it *SearchIter) Err() error {
+	return it.err
+}
+
+// Close ends the search, releasing its transaction.
+func (it *SearchIter) Close() {
+	it.finish()
+}
+
+func (it *SearchIter) finish() {
+	if it.done {
+		return
+	}
+	it.done = true
+	it.last = true
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	if it.txn != nil {
+		it.txn.Discard()
+		it.txn = nil
+	}
+	if it.started {
+		it.bucket.DB.logger.Debug("puredb: search stream", "bucket", it.bucket.Name, "scanned", it.scanned, "found", it.returned, "duration", time.Since(it.start), "err", it.err)
+	}
+}
@@ -0,0 +1,173 @@
+package puredb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestSearchStream(t *testing.T) {
+	forEachBackend(t, testSearchStream)
+}
+
+func testSearchStream(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("numbers", BucketOptsIntInt)
+	bucket := db.GetBucket("numbers")
+	for i := int64(0); i < 20; i++ {
+		bucket.Set(i, i%4)
+	}
+
+	even := func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+		return k.(int64)%2 == 0, nil
+	}
+	collect := func(it *SearchIter) string {
+		defer it.Close()
+		var found []interface{}
+		for it.Next() {
+			found = append(found, it.Key())
+		}
+		if it.Err() != nil {
+			t.Fatalf("search failed - err:%v", it.Err())
+		}
+		return fmt.Sprint(found)
+	}
+
+	ctx := context.Background()
+	if s := collect(bucket.SearchStream(ctx, int64(3), nil, false)); s != "[3 7 11 15 19]" {
+		t.Fatalf("found %v", s)
+	}
+	if s := collect(bucket.SearchStream(ctx, nil, even, true).Limit(3)); s != "[18 16 14]" {
+		t.Fatalf("found %v in reverse", s)
+	}
+	if s := collect(bucket.SearchStream(ctx, nil, even, false).Limit(0)); s != "[]" {
+		t.Fatalf("found %v with no limit", s)
+	}
+
+	// the predicate stops the search
+	stopAt := func(at int64) BucketPredicate {
+		return func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+			found, _ := even(bucket, k, v)
+			if k.(int64) == at {
+				return found, Stop
+			}
+			return found, nil
+		}
+	}
+	if s := collect(bucket.SearchStream(ctx, nil, stopAt(6), false)); s != "[0 2 4 6]" {
+		t.Fatalf("found %v stopping at a match", s)
+	}
+	if s := collect(bucket.SearchStream(ctx, nil, stopAt(7), false)); s != "[0 2 4 6]" {
+		t.Fatalf("found %v stopping after a match", s)
+	}
+
+	// errors and cancellation end the search
+	fail := fmt.Errorf("fail")
+	it := bucket.SearchStream(ctx, nil, func(*Bucket, interface{}, interface{}) (bool, error) { return false, fail }, false)
+	if it.Next() || it.Err() != fail {
+		t.Fatalf("search didn't fail - err:%v", it.Err())
+	}
+	it.Close()
+
+	cctx, cancel := context.WithCancel(ctx)
+	it = bucket.SearchStream(cctx, nil, even, false)
+	defer it.Close()
+	if !it.Next() || it.Key() != int64(0) {
+		t.Fatalf("search found %v", it.Key())
+	}
+	cancel()
+	if it.Next() || it.Err() != context.Canceled {
+		t.Fatalf("canceled search returned err:%v", it.Err())
+	}
+}
+
+func TestStop(t *testing.T) {
+	forEachBackend(t, testStop)
+}
+
+func testStop(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	db.AddBucket("numbers", BucketOptsIntInt)
+	bucket := db.GetBucket("numbers")
+	for i := int64(0); i < 10; i++ {
+		bucket.Set(i, i%3)
+	}
+
+	var keys []interface{}
+	err := bucket.Iterate(func(bucket *Bucket, k interface{}, v interface{}) error {
+		keys = append(keys, k)
+		if k == int64(4) {
+			return Stop
+		}
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[0 1 2 3 4]" {
+		t.Fatalf("iterated %v - err:%v", keys, err)
+	}
+	fail := fmt.Errorf("fail")
+	err = bucket.IterateKeys(func(bucket *Bucket, k interface{}) error {
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("iteration returned err:%v", err)
+	}
+
+	// Search passes all the matches to fn
+	keys = nil
+	first, err := bucket.Search(int64(1), func(bucket *Bucket, k interface{}, v interface{}) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil || first != int64(1) || fmt.Sprint(keys) != "[1 4 7]" {
+		t.Fatalf("search found %v first and %v - err:%v", first, keys, err)
+	}
+	keys = nil
+	first, err = bucket.Search(int64(2), func(bucket *Bucket, k interface{}, v interface{}) error {
+		keys = append(keys, k)
+		return Stop
+	})
+	if err != nil || first != int64(2) || fmt.Sprint(keys) != "[2]" {
+		t.Fatalf("stopped search found %v first and %v - err:%v", first, keys, err)
+	}
+	if _, err := bucket.Search(int64(2), func(*Bucket, interface{}, interface{}) error { return fail }); err != fail {
+		t.Fatalf("search returned err:%v", err)
+	}
+	if first, err := bucket.Search(int64(0), nil); err != nil || first != int64(0) {
+		t.Fatalf("search found %v - err:%v", first, err)
+	}
+
+	it := NewBucketIter(bucket, BucketIterOpts{})
+	defer it.Close()
+	var k interface{}
+	found, err := it.Find(nil, func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+		return false, Stop
+	}, &k)
+	if found || err != nil || it.Err != nil {
+		t.Fatalf("stopped find returned %v - err:%v", found, err)
+	}
+	it.Next()
+	found, err = it.Find(nil, func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+		return v == int64(1), Stop
+	}, &k)
+	if !found || err != nil || k != int64(1) {
+		t.Fatalf("stopped find returned %v, %v - err:%v", found, k, err)
+	}
+	it.Next()
+	found, err = it.Find(nil, func(bucket *Bucket, k interface{}, v interface{}) (bool, error) {
+		return v == int64(2), Stop
+	}, &k)
+	if !found || err != nil || k != int64(2) {
+		t.Fatalf("stopped find returned %v, %v - err:%v", found, k, err)
+	}
+
+	err = bucket.ParallelScan(context.Background(), 2, func(*Bucket, interface{}, interface{}) error {
+		return Stop
+	})
+	if err != nil {
+		t.Fatalf("stopped scan returned err:%v", err)
+	}
+}
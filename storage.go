@@ -0,0 +1,167 @@
+package puredb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Storage implementations. Engines must translate their
+// own errors into these, so that buckets can check them whatever engine
+// they run on.
+var (
+	// ErrKeyNotFound is returned when a key is not present.
+	ErrKeyNotFound = errors.New("puredb: key not found")
+
+	// ErrConflict is returned by Commit when a read-write transaction
+	// conflicts with another one committed in the meantime. The operation
+	// can be retried.
+	ErrConflict = errors.New("puredb: transaction conflict")
+
+	// ErrReadOnlyTxn is returned by Set and Delete on read-only
+	// transactions.
+	ErrReadOnlyTxn = errors.New("puredb: read-only transaction")
+
+	// ErrDiscardedTxn is returned when using a transaction after Commit or
+	// Discard.
+	ErrDiscardedTxn = errors.New("puredb: transaction discarded")
+
+	// ErrEmptyKey is returned when using an empty key.
+	ErrEmptyKey = errors.New("puredb: empty key")
+)
+
+// Storage is the ordered key-value engine buckets are written against.
+//
+// PureDB ships with a badger implementation (the default, see
+// NewBadgerStorage) and a pure in-memory one (see NewMemoryStorage); other
+// engines can be plugged in with WithStorage.
+//
+// Keys are ordered by bytes.Compare. Transactions must provide snapshot
+// isolation, and read-write transactions must fail on Commit with
+// ErrConflict when a key they read has been committed by another
+// transaction after they started.
+type Storage interface {
+	// NewTransaction starts a transaction over a consistent snapshot.
+	NewTransaction(update bool) StorageTxn
+	// GetSequence returns a monotonically increasing sequence stored
+	// under key, leasing bandwidth numbers at a time.
+	GetSequence(key []byte, bandwidth uint64) (StorageSequence, error)
+	Close() error
+}
+
+// StorageTxn is a Storage transaction.
+type StorageTxn interface {
+	// Get returns the value stored at key, or ErrKeyNotFound. The value is
+	// only valid until the transaction is discarded.
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// NewIterator returns an iterator over the transaction snapshot. Only
+	// one iterator can be open at a time on a transaction.
+	NewIterator(opts StorageIteratorOptions) StorageIterator
+	Commit() error
+	// Discard releases the transaction. It can be called after Commit.
+	Discard()
+}
+
+// StorageIteratorOptions controls a StorageIterator.
+type StorageIteratorOptions struct {
+	// PrefetchValues, when false, hints that only keys are needed.
+	PrefetchValues bool
+	// PrefetchSize is the number of values to fetch ahead.
+	PrefetchSize int
+	// Reverse iterates in descending key order.
+	Reverse bool
+}
+
+var defaultIteratorOptions = StorageIteratorOptions{
+	PrefetchValues: true,
+	PrefetchSize:   100,
+	Reverse:        false,
+}
+
+// StorageIterator iterates over the keys of a transaction in order.
+type StorageIterator interface {
+	// Seek moves to key, or to the first key after it (before it, when
+	// iterating in reverse) when key is not present.
+	Seek(key []byte)
+	// Rewind moves to the first key (the last one, in reverse).
+	Rewind()
+	Valid() bool
+	ValidForPrefix(prefix []byte) bool
+	Next()
+	// Key returns the current key, valid until the next call to Next.
+	Key() []byte
+	// Value returns the current value, valid until the transaction ends.
+	Value() ([]byte, error)
+	Close()
+}
+
+// StorageSequence hands out monotonically increasing numbers, starting
+// from 0.
+type StorageSequence interface {
+	Next() (uint64, error)
+	// Release gives back the numbers leased but not used yet.
+	Release() error
+}
+
+// WithStorage makes the database use the given storage engine instead of
+// opening a badger database at pathname. The options configuring badger
+// are ignored, and the database takes ownership of the storage: Close and
+// Destroy close it.
+func WithStorage(s Storage) PureDBOptionFn {
+	return func(db *PureDB) error {
+		if s == nil {
+			return fmt.Errorf("puredb: WithStorage requires a non-nil storage")
+		}
+		db.storage = s
+		return nil
+	}
+}
+
+// Storage returns the storage engine of the database.
+func (db *PureDB) Storage() Storage {
+	return db.storage
+}
+
+// view runs fn in a read-only transaction.
+func (db *PureDB) view(fn func(txn StorageTxn) error) error {
+	txn := db.storage.NewTransaction(false)
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
+// updateTxn is the transaction update passes to its function, holding the
+// work to do once it's committed.
+type updateTxn struct {
+	StorageTxn
+	committed []func()
+}
+
+// update runs fn in a read-write transaction, committing it if fn succeeds.
+func (db *PureDB) update(fn func(txn StorageTxn) error) error {
+	txn := &updateTxn{StorageTxn: db.storage.NewTransaction(true)}
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	for _, f := range txn.committed {
+		f()
+	}
+	return nil
+}
+
+// afterCommit runs f once txn, started by update, is committed, and never
+// if it's discarded or fails to commit. f runs right away for the other
+// transactions.
+func afterCommit(txn StorageTxn, f func()) {
+	if txn, ok := txn.(*updateTxn); ok {
+		txn.committed = append(txn.committed, f)
+		return
+	}
+	f()
+}
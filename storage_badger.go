@@ -0,0 +1,105 @@
+package puredb
+
+import "github.com/dgraph-io/badger"
+
+// badgerStorage adapts a *badger.DB to the Storage interface.
+type badgerStorage struct {
+	db *badger.DB
+}
+
+// NewBadgerStorage opens (or creates) the badger database configured by
+// opts and returns it as a Storage.
+func NewBadgerStorage(opts badger.Options) (Storage, error) {
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerStorage{db: db}, nil
+}
+
+func (s *badgerStorage) NewTransaction(update bool) StorageTxn {
+	return &badgerTxn{txn: s.db.NewTransaction(update)}
+}
+
+func (s *badgerStorage) GetSequence(key []byte, bandwidth uint64) (StorageSequence, error) {
+	seq, err := s.db.GetSequence(key, bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+func (s *badgerStorage) Close() error {
+	return s.db.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t *badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err != nil {
+		return nil, badgerError(err)
+	}
+	v, err := item.Value()
+	return v, badgerError(err)
+}
+
+func (t *badgerTxn) Set(key, value []byte) error {
+	return badgerError(t.txn.Set(key, value))
+}
+
+func (t *badgerTxn) Delete(key []byte) error {
+	return badgerError(t.txn.Delete(key))
+}
+
+func (t *badgerTxn) NewIterator(opts StorageIteratorOptions) StorageIterator {
+	bOpts := badger.DefaultIteratorOptions
+	bOpts.PrefetchValues = opts.PrefetchValues
+	bOpts.PrefetchSize = opts.PrefetchSize
+	bOpts.Reverse = opts.Reverse
+	return &badgerIterator{it: t.txn.NewIterator(bOpts)}
+}
+
+func (t *badgerTxn) Commit() error {
+	return badgerError(t.txn.Commit(nil))
+}
+
+func (t *badgerTxn) Discard() {
+	t.txn.Discard()
+}
+
+type badgerIterator struct {
+	it *badger.Iterator
+}
+
+func (it *badgerIterator) Seek(key []byte)                   { it.it.Seek(key) }
+func (it *badgerIterator) Rewind()                           { it.it.Rewind() }
+func (it *badgerIterator) Valid() bool                       { return it.it.Valid() }
+func (it *badgerIterator) ValidForPrefix(prefix []byte) bool { return it.it.ValidForPrefix(prefix) }
+func (it *badgerIterator) Next()                             { it.it.Next() }
+func (it *badgerIterator) Key() []byte                       { return it.it.Item().Key() }
+func (it *badgerIterator) Close()                            { it.it.Close() }
+
+func (it *badgerIterator) Value() ([]byte, error) {
+	v, err := it.it.Item().Value()
+	return v, badgerError(err)
+}
+
+// badgerError translates the errors of badger into the Storage ones.
+func badgerError(err error) error {
+	switch err {
+	case badger.ErrKeyNotFound:
+		return ErrKeyNotFound
+	case badger.ErrConflict:
+		return ErrConflict
+	case badger.ErrReadOnlyTxn:
+		return ErrReadOnlyTxn
+	case badger.ErrDiscardedTxn:
+		return ErrDiscardedTxn
+	case badger.ErrEmptyKey:
+		return ErrEmptyKey
+	}
+	return err
+}
@@ -0,0 +1,293 @@
+package puredb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// memoryStorage keeps the whole database in a persistent B-tree.
+//
+// Transactions work on a snapshot of the tree and are committed with the
+// same optimistic concurrency control as badger: a read-write transaction
+// fails with ErrConflict if any key it read was committed by another
+// transaction after it started.
+type memoryStorage struct {
+	mu      sync.Mutex
+	tree    *btree
+	version uint64
+	// commits maps keys to the version that last wrote them. It's only
+	// needed while read-write transactions are open, and is reset when the
+	// last one ends.
+	commits map[string]uint64
+	active  int
+}
+
+// NewMemoryStorage returns an empty in-memory Storage, the one used by
+// WithInMemory.
+func NewMemoryStorage() Storage {
+	return newMemoryStorage()
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		tree:    &btree{},
+		commits: make(map[string]uint64),
+	}
+}
+
+func (s *memoryStorage) NewTransaction(update bool) StorageTxn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn := &memoryTxn{
+		storage:     s,
+		update:      update,
+		readVersion: s.version,
+		tree:        s.tree,
+	}
+	if update {
+		txn.writes = make(map[string][]byte)
+		txn.reads = make(map[string]struct{})
+		s.active++
+	}
+	return txn
+}
+
+func (s *memoryStorage) GetSequence(key []byte, bandwidth uint64) (StorageSequence, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if bandwidth == 0 {
+		return nil, fmt.Errorf("puredb: sequence bandwidth must be at least 1")
+	}
+	return &memorySequence{storage: s, key: append([]byte(nil), key...)}, nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tree = &btree{}
+	return nil
+}
+
+// commit applies writes atomically, failing if any of the reads was
+// written by a transaction committed after readVersion.
+func (s *memoryStorage) commit(readVersion uint64, reads map[string]struct{}, writes map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k := range reads {
+		if s.commits[k] > readVersion {
+			return ErrConflict
+		}
+	}
+
+	s.version++
+	tree := s.tree
+	for k, v := range writes {
+		if v == nil {
+			tree = tree.delete([]byte(k))
+		} else {
+			tree = tree.set([]byte(k), v)
+		}
+		if s.active > 1 {
+			s.commits[k] = s.version
+		}
+	}
+	s.tree = tree
+	return nil
+}
+
+func (s *memoryStorage) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.active == 0 && len(s.commits) > 0 {
+		s.commits = make(map[string]uint64)
+	}
+}
+
+type memoryTxn struct {
+	storage     *memoryStorage
+	update      bool
+	readVersion uint64
+	// tree is the snapshot the transaction started from, plus its own
+	// writes.
+	tree *btree
+	// writes holds the pending writes, nil values are deletions.
+	writes    map[string][]byte
+	reads     map[string]struct{}
+	discarded bool
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	if t.discarded {
+		return nil, ErrDiscardedTxn
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	t.addRead(key)
+	v, ok := t.tree.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	if err := t.checkWrite(key); err != nil {
+		return err
+	}
+	k := append([]byte(nil), key...)
+	v := append(make([]byte, 0, len(value)), value...)
+	t.tree = t.tree.set(k, v)
+	t.writes[string(k)] = v
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if err := t.checkWrite(key); err != nil {
+		return err
+	}
+	t.tree = t.tree.delete(key)
+	t.writes[string(key)] = nil
+	return nil
+}
+
+func (t *memoryTxn) NewIterator(opts StorageIteratorOptions) StorageIterator {
+	return &memoryIterator{txn: t, tree: t.tree, reverse: opts.Reverse}
+}
+
+func (t *memoryTxn) Commit() error {
+	if t.discarded {
+		return ErrDiscardedTxn
+	}
+	defer t.Discard()
+
+	if len(t.writes) == 0 {
+		return nil
+	}
+	return t.storage.commit(t.readVersion, t.reads, t.writes)
+}
+
+func (t *memoryTxn) Discard() {
+	if t.discarded {
+		return
+	}
+	t.discarded = true
+	if t.update {
+		t.storage.release()
+	}
+}
+
+func (t *memoryTxn) checkWrite(key []byte) error {
+	switch {
+	case t.discarded:
+		return ErrDiscardedTxn
+	case !t.update:
+		return ErrReadOnlyTxn
+	case len(key) == 0:
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+func (t *memoryTxn) addRead(key []byte) {
+	if t.update {
+		t.reads[string(key)] = struct{}{}
+	}
+}
+
+// memoryIterator walks a snapshot of the tree taken when it was created,
+// so writes made by the transaction while iterating are not visible.
+type memoryIterator struct {
+	txn     *memoryTxn
+	tree    *btree
+	reverse bool
+	item    *btreeItem
+}
+
+func (it *memoryIterator) Seek(key []byte) {
+	if it.reverse {
+		it.item = it.tree.seekLE(key)
+	} else {
+		it.item = it.tree.seekGE(key)
+	}
+}
+
+func (it *memoryIterator) Rewind() {
+	if it.reverse {
+		it.item = it.tree.max()
+	} else {
+		it.item = it.tree.min()
+	}
+}
+
+func (it *memoryIterator) Valid() bool {
+	return it.item != nil
+}
+
+func (it *memoryIterator) ValidForPrefix(prefix []byte) bool {
+	return it.item != nil && bytes.HasPrefix(it.item.key, prefix)
+}
+
+func (it *memoryIterator) Next() {
+	if it.item == nil {
+		return
+	}
+	if it.reverse {
+		it.item = it.tree.seekLT(it.item.key)
+	} else {
+		it.item = it.tree.seekGT(it.item.key)
+	}
+}
+
+func (it *memoryIterator) Key() []byte {
+	it.txn.addRead(it.item.key)
+	return it.item.key
+}
+
+func (it *memoryIterator) Value() ([]byte, error) {
+	it.txn.addRead(it.item.key)
+	return it.item.value, nil
+}
+
+func (it *memoryIterator) Close() {
+}
+
+// memorySequence stores the next number at key after every call, so there
+// are never gaps: the bandwidth only matters for persistent storages.
+type memorySequence struct {
+	mu      sync.Mutex
+	storage *memoryStorage
+	key     []byte
+}
+
+func (seq *memorySequence) Next() (uint64, error) {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	s := seq.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next uint64
+	if v, ok := s.tree.get(seq.key); ok {
+		next = binary.BigEndian.Uint64(v)
+	}
+	s.version++
+	s.tree = s.tree.set(seq.key, u64tob(next+1))
+	if s.active > 0 {
+		s.commits[string(seq.key)] = s.version
+	}
+	return next, nil
+}
+
+func (seq *memorySequence) Release() error {
+	return nil
+}
@@ -0,0 +1,173 @@
+package puredb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ref := make(map[string]string)
+	tree := &btree{}
+
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("k%05d", rnd.Intn(3000))
+		if rnd.Intn(3) == 0 {
+			tree = tree.delete([]byte(k))
+			delete(ref, k)
+		} else {
+			v := fmt.Sprintf("v%d", i)
+			tree = tree.set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+	}
+
+	snapshot := tree
+	snapshotLen := len(ref)
+	for k := range ref {
+		if rnd.Intn(2) == 0 {
+			tree = tree.delete([]byte(k))
+			delete(ref, k)
+		}
+	}
+	if snapshot.Len() != snapshotLen {
+		t.Fatalf("snapshot changed after deletes: %d items, expected %d", snapshot.Len(), snapshotLen)
+	}
+
+	keys := make([]string, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if tree.Len() != len(keys) {
+		t.Fatalf("tree has %d items, expected %d", tree.Len(), len(keys))
+	}
+	i := 0
+	for item := tree.min(); item != nil; item = tree.seekGT(item.key) {
+		if string(item.key) != keys[i] || string(item.value) != ref[keys[i]] {
+			t.Fatalf("item %d is %s=%s, expected %s=%s", i, item.key, item.value, keys[i], ref[keys[i]])
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("forward walk returned %d items, expected %d", i, len(keys))
+	}
+	for item := tree.max(); item != nil; item = tree.seekLT(item.key) {
+		i--
+		if string(item.key) != keys[i] {
+			t.Fatalf("reverse item %d is %s, expected %s", i, item.key, keys[i])
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	forEachBackend(t, testStorage)
+}
+
+func testStorage(t *testing.T, options ...PureDBOptionFn) {
+	db := OpenTestDB(t, options...)
+	defer db.Destroy()
+
+	err := db.update(func(txn StorageTxn) error {
+		for _, k := range []string{"a1", "b1", "b2", "b3", "c1"} {
+			if err := txn.Set([]byte(k), []byte("v"+k)); err != nil {
+				return err
+			}
+		}
+		return txn.Delete([]byte("b2"))
+	})
+	if err != nil {
+		t.Fatalf("can't write keys - err:%v", err)
+	}
+
+	scan := func(seek string, reverse bool) []string {
+		var keys []string
+		db.view(func(txn StorageTxn) error {
+			opts := defaultIteratorOptions
+			opts.Reverse = reverse
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Seek([]byte(seek)); it.ValidForPrefix([]byte("b")); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			return nil
+		})
+		return keys
+	}
+	if keys := scan("b", false); fmt.Sprint(keys) != "[b1 b3]" {
+		t.Fatalf("forward scan returned %v", keys)
+	}
+	if keys := scan("b9", true); fmt.Sprint(keys) != "[b3 b1]" {
+		t.Fatalf("reverse scan returned %v", keys)
+	}
+
+	// a read-write transaction fails if a key it read changed meanwhile
+	txn := db.storage.NewTransaction(true)
+	if _, err := txn.Get([]byte("a1")); err != nil {
+		t.Fatalf("can't get key - err:%v", err)
+	}
+	err = db.update(func(txn StorageTxn) error {
+		return txn.Set([]byte("a1"), []byte("changed"))
+	})
+	if err != nil {
+		t.Fatalf("can't update key - err:%v", err)
+	}
+	txn.Set([]byte("c1"), []byte("conflicting"))
+	if err := txn.Commit(); err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	db.view(func(txn StorageTxn) error {
+		v, err := txn.Get([]byte("c1"))
+		if err != nil || !bytes.Equal(v, []byte("vc1")) {
+			t.Fatalf("conflicting write was applied - v:%s err:%v", v, err)
+		}
+		_, err = txn.Get([]byte("b2"))
+		if err != ErrKeyNotFound {
+			t.Fatalf("expected ErrKeyNotFound for deleted key, got %v", err)
+		}
+		return nil
+	})
+
+	seq, err := db.storage.GetSequence([]byte("seq"), 10)
+	if err != nil {
+		t.Fatalf("can't get sequence - err:%v", err)
+	}
+	for i := uint64(0); i < 3; i++ {
+		n, err := seq.Next()
+		if err != nil || n != i {
+			t.Fatalf("sequence returned %v, expected %v (err:%v)", n, i, err)
+		}
+	}
+	seq.Release()
+}
+
+func TestWithStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	db, err := Open("", WithStorage(storage))
+	if err != nil {
+		t.Fatal("can't open db", err)
+	}
+	defer db.Destroy()
+
+	if db.Storage() != storage {
+		t.Fatal("database is not using the given storage")
+	}
+
+	db.AddBucket("counters", BucketOptsIntInt)
+	id, err := db.GetBucket("counters").Add(int64(42))
+	if err != nil {
+		t.Fatalf("can't add - err:%v", err)
+	}
+	err = db.view(func(txn StorageTxn) error {
+		_, err := txn.Get(append([]byte("counters__"), i64tob(id)...))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("value not found in the given storage - err:%v", err)
+	}
+}